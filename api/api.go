@@ -5,22 +5,43 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"net/http"
 	"os"
+	"strings"
 	"time"
 
+	cloud "neptune-aws-api/cloud"
+	lifecycle "neptune-aws-api/lifecycle"
+	plans "neptune-aws-api/plans"
+	preprovision "neptune-aws-api/preprovision"
+	reconcile "neptune-aws-api/reconcile"
+	replicas "neptune-aws-api/replicas"
+	rotation "neptune-aws-api/rotation"
+	secrets "neptune-aws-api/secrets"
+	teardown "neptune-aws-api/teardown"
+
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/iam"
 	"github.com/aws/aws-sdk-go/service/neptune"
 	"github.com/go-martini/martini"
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 	"github.com/martini-contrib/binding"
 	"github.com/martini-contrib/render"
+	uuid "github.com/nu7hatch/gouuid"
 )
 
 type provisionspec struct {
-	Plan        string `json:"plan"`
-	Billingcode string `json:"billingcode"`
+	Plan               string `json:"plan"`
+	Billingcode        string `json:"billingcode"`
+	FromSnapshot       string `json:"from_snapshot"`
+	DeletionProtection bool   `json:"deletion_protection"`
+}
+type clonespec struct {
+	Billingcode        string     `json:"billingcode"`
+	RestoreTime        *time.Time `json:"restore_time"`
+	DeletionProtection bool       `json:"deletion_protection"`
+}
+type protectionspec struct {
+	Enabled *bool `json:"enabled"`
 }
 type tagspec struct {
 	Resource string `json:"resource"`
@@ -31,39 +52,74 @@ type dbspec struct {
 	AccessKeyID     string
 	SecretAccessKey string
 	Endpoint        string
+	ReaderEndpoint  string
 }
 
 var pool *sql.DB
-var plans map[string]interface{}
 
-// TODO: what error should we display if the accesskey/secretkey is not in the DB?
-// TODO: What if instance/cluster exists in database but has been deleted in AWS (for DELETE, GET)?
-// TODO: What if user, policy DNE in AWS when we try to delete the instance?
+var errNoInstances = errors.New("No available instances. Try again in 10 minutes")
+var errDeleting = errors.New("Instance is already being deleted")
+var errProtected = errors.New("Deletion protection is enabled, disable it before deleting the instance")
+var errEndpointPending = errors.New("Endpoint not available, try again in a few minutes")
+var errCredentialsMissing = errors.New("Credentials of the instance are missing, run `neptune reconcile fix` to repair them")
+var errClusterNotFound = errors.New("Cluster of the instance was not found, run `neptune reconcile` to report it")
+
+// Rows whose cluster, IAM user or access key has gone missing in AWS are reported by
+// /v1/neptune/reconcile and repaired by `neptune reconcile fix` (see reconcile). Until then
+// /v1/neptune/url/:name answers them with a 409 saying what is missing (see getDBInfo).
+// Deleting an instance treats IAM users, keys and policies that no longer exist as removed,
+// and retries the rest in the background (see teardown).
 
 // Run - starts the API
 func Run() {
 	pool = setupDB()
 
-	// Create plans
-	plans = make(map[string]interface{})
-	plans["small"] = "Small DB Instance - 2vCPU, 15.25 GiB RAM - $245/mo"
-
 	m := martini.Classic()
 	m.Use(render.Renderer())
 
 	m.Post("/v1/neptune/instance", binding.Json(provisionspec{}), claimInstance)
+	m.Get("/v1/neptune/instances", listInstances)
+	m.Get("/v1/neptune/instance/:name", getInstanceStatus)
+	m.Patch("/v1/neptune/instance/:name", binding.Json(planchangespec{}), changePlan)
 	m.Delete("/v1/neptune/instance/:name", deleteInstance)
 	m.Get("/v1/neptune/url/:name", getInstance)
-	m.Get("/v1/neptune/plans", func(r render.Render) { r.JSON(200, plans) })
+	m.Get("/v1/neptune/plans", getPlans)
 	m.Post("/v1/neptune/tag", binding.Json(tagspec{}), tagInstance)
+	m.Get("/v1/neptune/reconcile", getReconcileReport)
+	m.Get("/v1/neptune/teardowns", listTeardowns)
+	m.Post("/v1/neptune/teardowns/:id/retry", retryTeardown)
+	m.Post("/v1/neptune/instance/:name/bindings", createBinding)
+	m.Get("/v1/neptune/instance/:name/bindings", listBindings)
+	m.Delete("/v1/neptune/instance/:name/bindings/:id", deleteBinding)
+	m.Post("/v1/neptune/instance/:name/rotate", rotateInstance)
+	m.Post("/v1/neptune/instance/:name/snapshots", createSnapshot)
+	m.Get("/v1/neptune/instance/:name/snapshots", listSnapshots)
+	m.Delete("/v1/neptune/instance/:name/snapshots/:id", deleteSnapshot)
+	m.Post("/v1/neptune/instance/:name/replicas", createReplica)
+	m.Get("/v1/neptune/instance/:name/replicas", listReplicas)
+	m.Delete("/v1/neptune/instance/:name/replicas/:id", deleteReplica)
+	m.Post("/v1/neptune/instance/:name/failover", failoverInstance)
+	m.Post("/v1/neptune/instance/:name/reboot", rebootInstance)
+	m.Post("/v1/neptune/instance/:name/stop", stopInstance)
+	m.Post("/v1/neptune/instance/:name/start", startInstance)
+	m.Post("/v1/neptune/instance/:name/clone", binding.Json(clonespec{}), cloneInstance)
+	m.Post("/v1/neptune/instance/:name/restore", undeleteInstance)
+	m.Put("/v1/neptune/instance/:name/capacity", binding.Json(capacityspec{}), setCapacity)
+	m.Put("/v1/neptune/instance/:name/deletion_protection", binding.Json(protectionspec{}), setInstanceDeletionProtection)
+
+	// Open Service Broker API
+	m.Get("/v2/catalog", getCatalog)
+	m.Put("/v2/service_instances/:instance_id", binding.Json(osbprovisionspec{}), provisionServiceInstance)
+	m.Delete("/v2/service_instances/:instance_id", deprovisionServiceInstance)
+	m.Get("/v2/service_instances/:instance_id/last_operation", getLastOperation)
+	m.Put("/v2/service_instances/:instance_id/service_bindings/:binding_id", binding.Json(osbbindspec{}), bindServiceInstance)
+	m.Delete("/v2/service_instances/:instance_id/service_bindings/:binding_id", unbindServiceInstance)
 
 	m.Run()
 }
 
 // Mark a specified instance as 'claimed' and send the instance's endpoint as a response
 func claimInstance(spec provisionspec, err binding.Errors, r render.Render) {
-	var name string
-
 	//Bad JSON
 	if spec.Plan == "" || spec.Billingcode == "" {
 		fmt.Println("Invalid JSON")
@@ -71,87 +127,121 @@ func claimInstance(spec provisionspec, err binding.Errors, r render.Render) {
 		return
 	}
 
-	_, ok := plans[spec.Plan]
-	if !ok {
+	_, perr := plans.Get(spec.Plan)
+	if perr != nil {
 		fmt.Println("Invalid plan")
 		r.Text(400, "Bad Request")
 		return
 	}
 
-	dberr := pool.QueryRow("SELECT name FROM provision WHERE plan=$1 AND claimed='no' AND makedate=(SELECT min(makedate) FROM provision WHERE plan=$1 AND claimed='no')", spec.Plan).Scan(&name)
-	if dberr != nil && dberr.Error() == "sql: no rows in result set" {
-		fmt.Println("No available instances")
-		r.JSON(503, map[string]string{"error": "No available instances. Try again in 10 minutes"})
-		return
-	} else if dberr != nil {
-		output500Error(r, dberr)
+	if spec.FromSnapshot != "" {
+		restoreInstance(spec, r)
 		return
 	}
 
-	fmt.Println("Claiming " + name + "...")
+	name, cerr := claim(spec.Plan, spec.Billingcode, "")
+	if cerr == errNoInstances {
+		r.JSON(503, map[string]string{"error": cerr.Error()})
+		return
+	} else if cerr != nil {
+		output500Error(r, cerr)
+		return
+	}
 
-	available := isAvailable(name)
-	if available {
-		_, dberr = pool.Exec("UPDATE provision SET claimed='yes', billingcode=$1 WHERE name=$2", spec.Billingcode, name)
-		if dberr != nil {
-			output500Error(r, dberr)
+	if spec.DeletionProtection {
+		perr = setDeletionProtection(name, true)
+		if perr != nil {
+			output500Error(r, perr)
 			return
 		}
+	}
 
-		region := os.Getenv("REGION")
-		svc := neptune.New(session.New(&aws.Config{
-			Region: aws.String(region),
-		}))
-		accountnumber := os.Getenv("ACCOUNTNUMBER")
-		clusterarn := "arn:aws:rds:" + region + ":" + accountnumber + ":cluster:" + name
-		instancearn := "arn:aws:rds:" + region + ":" + accountnumber + ":db:" + name
-
-		clusterParams := &neptune.AddTagsToResourceInput{
-			ResourceName: aws.String(clusterarn),
-			Tags: []*neptune.Tag{ // Required
-				{
-					Key:   aws.String("billingcode"),
-					Value: aws.String(spec.Billingcode),
-				},
-			},
-		}
+	dbinfo, dberr := getDBInfo(name)
+	if dberr != nil {
+		outputDBInfoError(r, dberr)
+		return
+	}
+	r.JSON(200, credentialsResponse(dbinfo))
+}
 
-		_, awserr := svc.AddTagsToResource(clusterParams)
-		if awserr != nil {
-			output500Error(r, awserr)
-			return
-		}
+// Provision a new claimed instance restored from a snapshot. Its endpoint isn't ready yet, so
+// the caller polls /v1/neptune/url/:name until it returns the credentials. Only snapshots of
+// instances with the caller's billingcode can be restored, those of other instances are
+// reported as not existing.
+func restoreInstance(spec provisionspec, r render.Render) {
+	var status, billingcode string
+	err := pool.QueryRow("SELECT s.status, coalesce(p.billingcode, s.billingcode, '') FROM snapshots s LEFT JOIN provision p ON p.name = s.name WHERE s.id=$1", spec.FromSnapshot).Scan(&status, &billingcode)
+	if err == sql.ErrNoRows || (err == nil && billingcode != spec.Billingcode) {
+		r.JSON(404, map[string]string{"error": "Snapshot " + spec.FromSnapshot + " does not exist"})
+		return
+	} else if err != nil {
+		output500Error(r, err)
+		return
+	}
+	if status != "available" {
+		r.JSON(409, map[string]string{"error": "Snapshot " + spec.FromSnapshot + " is " + status})
+		return
+	}
 
-		instanceParams := &neptune.AddTagsToResourceInput{
-			ResourceName: aws.String(instancearn),
-			Tags: []*neptune.Tag{ // Required
-				{
-					Key:   aws.String("billingcode"),
-					Value: aws.String(spec.Billingcode),
-				},
-			},
-		}
+	name, err := preprovision.Restore(spec.Plan, spec.FromSnapshot, spec.Billingcode, spec.DeletionProtection)
+	if err != nil {
+		output500Error(r, err)
+		return
+	}
 
-		_, awserr = svc.AddTagsToResource(instanceParams)
-		if awserr != nil {
-			output500Error(r, awserr)
-			return
-		}
+	r.JSON(202, map[string]string{"name": name, "state": lifecycle.Creating, "url": "/v1/neptune/url/" + name})
+}
+
+// Provision a new claimed instance that is a copy of the cluster of a claimed instance, either as
+// it is now or as it was at restore_time. Like a restored instance, the caller polls
+// /v1/neptune/url/:name until it returns the credentials.
+func cloneInstance(spec clonespec, berr binding.Errors, params martini.Params, r render.Render) {
+	name := params["name"]
+
+	if berr != nil || spec.Billingcode == "" {
+		fmt.Println("Invalid JSON")
+		r.Text(400, "Bad Request")
+		return
+	}
 
-		dbinfo, err := getDBInfo(name)
+	if !instanceExists(name) {
+		fmt.Println("Instance with specified name does not exist in provision table")
+		r.Text(400, "Bad Request")
+		return
+	}
+
+	state := queryDB("state", name)
+	if state != lifecycle.Claimed {
+		r.JSON(409, map[string]string{"error": "Instance is " + state + ", only claimed instances can be cloned"})
+		return
+	}
+
+	if spec.RestoreTime != nil {
+		resp, err := cloud.Neptune().DescribeDBClusters(&neptune.DescribeDBClustersInput{
+			DBClusterIdentifier: aws.String(name),
+		})
 		if err != nil {
 			output500Error(r, err)
+			return
 		}
-		r.JSON(200, map[string]string{"NEPTUNE_DATABASE_URL": dbinfo.Endpoint, "NEPTUNE_ACCESS_KEY": dbinfo.AccessKeyID, "NEPTUNE_SECRET_KEY": dbinfo.SecretAccessKey, "NEPTUNE_REGION": os.Getenv("REGION")})
-	} else {
-		r.JSON(503, map[string]string{"error": "No available instances. Try again in 10 minutes"})
+		cluster := resp.DBClusters[0]
+		if cluster.EarliestRestorableTime == nil || cluster.LatestRestorableTime == nil || spec.RestoreTime.Before(*cluster.EarliestRestorableTime) || spec.RestoreTime.After(*cluster.LatestRestorableTime) {
+			r.JSON(400, map[string]string{"error": "restore_time must be between the earliest and latest restorable time of the instance"})
+			return
+		}
+	}
+
+	clone, err := preprovision.Clone(queryDB("plan", name), name, spec.RestoreTime, spec.Billingcode, spec.DeletionProtection)
+	if err != nil {
+		output500Error(r, err)
 		return
 	}
 
+	r.JSON(202, map[string]string{"name": clone, "state": lifecycle.Creating, "url": "/v1/neptune/url/" + clone})
 }
 
-// Delete a specified instance and remove its row from the database
-func deleteInstance(params martini.Params, r render.Render) {
+// Delete a specified instance, taking a final snapshot of its cluster if final_snapshot=true
+func deleteInstance(params martini.Params, req *http.Request, r render.Render) {
 	instanceName := params["name"]
 
 	if !instanceExists(instanceName) {
@@ -160,51 +250,95 @@ func deleteInstance(params martini.Params, r render.Render) {
 		return
 	}
 
-	svc := neptune.New(session.New(&aws.Config{
-		Region: aws.String(os.Getenv("REGION")),
-	}))
+	finalSnapshot := req.URL.Query().Get("final_snapshot") == "true"
 
-	instanceParamsDelete := &neptune.DeleteDBInstanceInput{
-		DBInstanceIdentifier: aws.String(instanceName),
-		SkipFinalSnapshot:    aws.Bool(true),
+	state := queryDB("state", instanceName)
+	if state == lifecycle.Starting {
+		r.JSON(409, map[string]string{"error": "Instance is starting, delete it once it has started"})
+		return
 	}
+	if state == lifecycle.Claimed || state == lifecycle.Stopped {
+		deleteafter, snapshot, err := softDelete(instanceName, state, finalSnapshot)
+		if err == errProtected || err == lifecycle.ErrStateChanged {
+			r.JSON(409, map[string]string{"error": err.Error()})
+			return
+		} else if err != nil {
+			output500Error(r, err)
+			return
+		}
 
-	clusterParamsDelete := &neptune.DeleteDBClusterInput{
-		DBClusterIdentifier: aws.String(instanceName),
-		SkipFinalSnapshot:   aws.Bool(true),
+		response := map[string]string{"Response": "Instance stopped, it will be deleted after " + deleteafter.Format(time.RFC3339), "delete_after": deleteafter.Format(time.RFC3339)}
+		if snapshot != "" {
+			response["final_snapshot"] = snapshot
+		}
+		r.JSON(200, response)
+		return
 	}
 
-	instanceResp, instanceErr := svc.DeleteDBInstance(instanceParamsDelete)
-	name := *instanceParamsDelete.DBInstanceIdentifier
-	if instanceErr != nil {
-		fmt.Println(instanceErr.Error())
-		output500Error(r, instanceErr)
+	snapshot, err := destroy(instanceName, finalSnapshot)
+	if err == errDeleting || err == errProtected || err == lifecycle.ErrStateChanged {
+		r.JSON(409, map[string]string{"error": err.Error()})
+		return
+	} else if err != nil {
+		output500Error(r, err)
 		return
 	}
-	fmt.Println("Deletion in progress for instance " + *instanceResp.DBInstance.DBInstanceIdentifier)
 
-	clusterResp, clusterErr := svc.DeleteDBCluster(clusterParamsDelete)
-	if clusterErr != nil {
-		fmt.Println(instanceErr.Error())
-		output500Error(r, clusterErr)
+	queueIAM(instanceName)
+
+	if snapshot != "" {
+		r.JSON(200, map[string]string{"Response": "Instance deletion in progress", "final_snapshot": snapshot})
+	} else {
+		r.JSON(200, map[string]string{"Response": "Instance deletion in progress"})
+	}
+
+	teardown.Finish(pool, instanceName)
+}
+
+// Enable or disable deletion protection of an instance. Instances that are still being created
+// are protected by the preprovisioner once their cluster is ready.
+func setInstanceDeletionProtection(spec protectionspec, berr binding.Errors, params martini.Params, r render.Render) {
+	name := params["name"]
+
+	if berr != nil || spec.Enabled == nil {
+		fmt.Println("Invalid JSON")
+		r.Text(400, "Bad Request")
 		return
 	}
-	fmt.Println("Deletion in progress for cluster " + *clusterResp.DBCluster.DBClusterIdentifier)
 
-	_, err := pool.Exec("DELETE FROM provision WHERE name=$1", name)
+	if !instanceExists(name) {
+		fmt.Println("Instance with specified name does not exist in provision table")
+		r.Text(400, "Bad Request")
+		return
+	}
+
+	var err error
+	state := queryDB("state", name)
+	switch state {
+	case lifecycle.Available, lifecycle.Claimed:
+		err = setDeletionProtection(name, *spec.Enabled)
+	case lifecycle.Creating, lifecycle.IAMPending:
+		_, err = pool.Exec("UPDATE provision SET deletionprotection=$1 WHERE name=$2", *spec.Enabled, name)
+	default:
+		r.JSON(409, map[string]string{"error": "Instance is " + state})
+		return
+	}
 	if err != nil {
-		fmt.Println(err.Error())
 		output500Error(r, err)
 		return
 	}
 
-	r.JSON(200, map[string]string{"Response": "Instance deletion in progress"})
-
-	username := *instanceParamsDelete.DBInstanceIdentifier
-	deleteUserPolicy(username)
-	deleteAccessKey(username)
-	deleteUser(username)
+	r.JSON(200, map[string]bool{"deletion_protection": *spec.Enabled})
+}
 
+// Send the name and description of every plan as a response
+func getPlans(r render.Render) {
+	summaries := make(map[string]string)
+	for _, name := range plans.Names() {
+		plan, _ := plans.Get(name)
+		summaries[name] = plan.Summary()
+	}
+	r.JSON(200, summaries)
 }
 
 // Send the endpoint of a specified instance as a response
@@ -217,12 +351,68 @@ func getInstance(params martini.Params, r render.Render) {
 		return
 	}
 
+	state := queryDB("state", name)
+	switch state {
+	case lifecycle.Available, lifecycle.Claimed:
+	case lifecycle.Creating, lifecycle.IAMPending:
+		r.JSON(503, map[string]string{"error": "Endpoint not available, try again in a few minutes"})
+		return
+	case lifecycle.Starting:
+		r.JSON(503, map[string]string{"error": "Instance is starting, try again in a few minutes"})
+		return
+	case lifecycle.Deleting:
+		r.JSON(409, map[string]string{"error": "Instance is being deleted"})
+		return
+	case lifecycle.PendingDeletion:
+		r.JSON(409, map[string]string{"error": "Instance is pending deletion, restore it to use it again"})
+		return
+	case lifecycle.Stopped:
+		r.JSON(409, map[string]string{"error": "Instance is stopped, start it to use it again"})
+		return
+	default:
+		r.JSON(500, map[string]string{"error": "Instance is " + state})
+		return
+	}
+
 	dbinfo, err := getDBInfo(name)
 	if err != nil {
+		outputDBInfoError(r, err)
+		return
+	}
+	r.JSON(200, credentialsResponse(dbinfo))
+}
+
+// Returns the credentials of an instance as they are sent when it is claimed or asked for. The
+// reader endpoint is only included while the instance has replicas.
+func credentialsResponse(dbinfo dbspec) map[string]string {
+	response := map[string]string{"NEPTUNE_DATABASE_URL": dbinfo.Endpoint, "NEPTUNE_ACCESS_KEY": dbinfo.AccessKeyID, "NEPTUNE_SECRET_KEY": dbinfo.SecretAccessKey, "NEPTUNE_REGION": os.Getenv("REGION")}
+	if dbinfo.ReaderEndpoint != "" {
+		response["NEPTUNE_READER_URL"] = dbinfo.ReaderEndpoint
+	}
+	return response
+}
+
+// Replace the access key of an instance and send the new credentials as a response. The old
+// access key keeps working until the rotation overlap period has passed.
+func rotateInstance(params martini.Params, r render.Render) {
+	name := params["name"]
+
+	if !instanceExists(name) {
+		fmt.Println("Instance with specified name does not exist in provision table")
+		r.Text(400, "Bad Request")
+		return
+	}
+
+	accesskey, secretkey, err := rotation.Rotate(pool, name)
+	if err == rotation.ErrPending || err == rotation.ErrNotRotatable {
+		r.JSON(409, map[string]string{"error": err.Error()})
+		return
+	} else if err != nil {
 		output500Error(r, err)
 		return
 	}
-	r.JSON(200, map[string]string{"NEPTUNE_DATABASE_URL": dbinfo.Endpoint, "NEPTUNE_ACCESS_KEY": dbinfo.AccessKeyID, "NEPTUNE_SECRET_KEY": dbinfo.SecretAccessKey, "NEPTUNE_REGION": os.Getenv("REGION")})
+
+	r.JSON(200, map[string]string{"NEPTUNE_DATABASE_URL": queryDB("endpoint", name), "NEPTUNE_ACCESS_KEY": accesskey, "NEPTUNE_SECRET_KEY": secretkey, "NEPTUNE_REGION": os.Getenv("REGION")})
 }
 
 // Tag a specified instance with the provided name and value
@@ -247,9 +437,7 @@ func tagInstance(spec tagspec, berr binding.Errors, r render.Render) {
 	}
 
 	region := os.Getenv("REGION")
-	svc := neptune.New(session.New(&aws.Config{
-		Region: aws.String(region),
-	}))
+	svc := cloud.Neptune()
 
 	accountnumber := os.Getenv("ACCOUNTNUMBER")
 	clusterarn := "arn:aws:rds:" + region + ":" + accountnumber + ":cluster:" + spec.Resource
@@ -287,134 +475,327 @@ func tagInstance(spec tagspec, berr binding.Errors, r render.Render) {
 		return
 	}
 
+	// Tags are kept in the tags table as well so that instances can be searched by them
+	_, err := pool.Exec("INSERT INTO tags(name, key, value) VALUES ($1, $2, $3) ON CONFLICT (name, key) DO UPDATE SET value=excluded.value", spec.Resource, spec.Name, spec.Value)
+	if err != nil {
+		output500Error(r, err)
+		return
+	}
+
 	fmt.Println("Successfully tagged " + spec.Resource + " with '" + spec.Name + "':'" + spec.Value + "'")
 
 	r.JSON(200, map[string]interface{}{"Response": "Tag added"})
 }
 
-// IAM Helper Functions
+// Claim the oldest available instance of a plan, tag it with the billingcode and return its name.
+// Candidates that are not yet available in AWS are skipped in favor of the next one, before
+// the row is locked with FOR UPDATE SKIP LOCKED so concurrent claims never receive the same
+// instance. The claim is only committed once the instance is tagged, so a failed claim leaves
+// it available.
+func claim(plan string, billingcode string, instanceID string) (name string, err error) {
+	var skipped []string
+
+	for {
+		err = pool.QueryRow("SELECT name FROM provision WHERE plan=$1 AND state=$2 AND NOT (name = ANY($3)) ORDER BY makedate LIMIT 1", plan, lifecycle.Available, pq.Array(skipped)).Scan(&name)
+		if err == sql.ErrNoRows {
+			fmt.Println("No available instances")
+			return "", errNoInstances
+		} else if err != nil {
+			return "", err
+		}
+
+		fmt.Println("Claiming " + name + "...")
+
+		if !isAvailable(name) {
+			skipped = append(skipped, name)
+			continue
+		}
+
+		tx, err := pool.Begin()
+		if err != nil {
+			return "", err
+		}
+
+		// Another claim may have taken the instance in the meantime
+		err = tx.QueryRow("SELECT name FROM provision WHERE name=$1 AND state=$2 FOR UPDATE SKIP LOCKED", name, lifecycle.Available).Scan(&name)
+		if err == sql.ErrNoRows {
+			tx.Rollback()
+			skipped = append(skipped, name)
+			continue
+		} else if err != nil {
+			tx.Rollback()
+			return "", err
+		}
 
-// Detach policy from user and delete it from AWS
-func deleteUserPolicy(neptuneName string) {
+		err = lifecycle.Transition(tx, name, lifecycle.Available, lifecycle.Claimed)
+		if err != nil {
+			tx.Rollback()
+			return "", err
+		}
 
-	svc := iam.New(session.New(&aws.Config{
-		Region: aws.String(os.Getenv("REGION")),
-	}))
+		_, err = tx.Exec("UPDATE provision SET billingcode=$1, instanceid=NULLIF($2, '') WHERE name=$3", billingcode, instanceID, name)
+		if err != nil {
+			tx.Rollback()
+			return "", err
+		}
 
-	policyarn := getPolicyARN(neptuneName)
-	deparams := &iam.DetachUserPolicyInput{
-		PolicyArn: aws.String(policyarn),   // Required
-		UserName:  aws.String(neptuneName), // Required
+		err = tagBillingcode(name, billingcode)
+		if err != nil {
+			tx.Rollback()
+			return "", err
+		}
+
+		return name, tx.Commit()
 	}
+}
 
-	_, err := svc.DetachUserPolicy(deparams)
+// Tag the cluster, instance and replicas of an instance with a billingcode. Replicas were tagged
+// with the empty billingcode of the pool, like a multi-AZ reader.
+func tagBillingcode(name string, billingcode string) error {
+	region := os.Getenv("REGION")
+	svc := cloud.Neptune()
+	accountnumber := os.Getenv("ACCOUNTNUMBER")
 
+	arns := []string{
+		"arn:aws:rds:" + region + ":" + accountnumber + ":cluster:" + name,
+		"arn:aws:rds:" + region + ":" + accountnumber + ":db:" + name,
+	}
+	ids, err := replicas.IDs(pool, name)
 	if err != nil {
-		fmt.Println(err.Error())
-		return
+		return err
+	}
+	for _, id := range ids {
+		arns = append(arns, "arn:aws:rds:"+region+":"+accountnumber+":db:"+id)
+	}
+
+	for _, arn := range arns {
+		_, err = svc.AddTagsToResource(&neptune.AddTagsToResourceInput{
+			ResourceName: aws.String(arn),
+			Tags: []*neptune.Tag{
+				{
+					Key:   aws.String("billingcode"),
+					Value: aws.String(billingcode),
+				},
+			},
+		})
+		if err != nil {
+			return err
+		}
 	}
+	return nil
+}
 
-	svc = iam.New(session.New(&aws.Config{
-		Region: aws.String(os.Getenv("REGION")),
-	}))
+// Delete the Neptune instance and cluster of a specified instance, optionally taking a final
+// snapshot of the cluster, and return the identifier of that snapshot
+func destroy(name string, finalSnapshot bool) (snapshot string, err error) {
+	state := queryDB("state", name)
+	if state == lifecycle.Deleting {
+		return "", errDeleting
+	}
+	if isProtected(name) {
+		return "", errProtected
+	}
 
-	params := &iam.DeletePolicyInput{
-		PolicyArn: aws.String(policyarn), // Required
+	if finalSnapshot {
+		snapshot = finalSnapshotName(name)
 	}
-	_, err = svc.DeletePolicy(params)
 
+	err = teardown.Instance(pool, name, state, snapshot)
 	if err != nil {
-		fmt.Println(err.Error())
-		return
+		return "", err
 	}
+	if queryDB("coalesce(finalsnapshot, '')", name) != snapshot {
+		// The cluster was already gone, so there is nothing to snapshot
+		return "", nil
+	}
+	return snapshot, nil
+}
 
+// Returns a new identifier for the final snapshot of an instance
+func finalSnapshotName(name string) string {
+	snapshotuuid, _ := uuid.NewV4()
+	return name + "-final-" + strings.Split(snapshotuuid.String(), "-")[0]
 }
 
-func getPolicyARN(neptuneName string) string {
+// Returns how long soft deleted instances are kept before they are deleted, RETENTION_PERIOD if set
+func retention() time.Duration {
+	period, err := time.ParseDuration(os.Getenv("RETENTION_PERIOD"))
+	if err != nil || period < 0 {
+		return 72 * time.Hour
+	}
+	return period
+}
 
-	svc := iam.New(session.New(&aws.Config{
-		Region: aws.String(os.Getenv("REGION")),
-	}))
-	params := &iam.ListAttachedUserPoliciesInput{
-		UserName: aws.String(neptuneName), // Required
+// Stop the cluster of a claimed or stopped instance and deactivate its access keys, keeping it
+// as pending_deletion until its retention period has passed. The preprovisioner deletes it then,
+// taking a final snapshot if one was asked for.
+func softDelete(name string, from string, finalSnapshot bool) (deleteafter time.Time, snapshot string, err error) {
+	if isProtected(name) {
+		return deleteafter, "", errProtected
 	}
-	resp, err := svc.ListAttachedUserPolicies(params)
 
+	err = teardown.SetKeysActive(pool, name, false)
 	if err != nil {
-		fmt.Println(err.Error())
+		return deleteafter, "", err
 	}
 
-	policyarn := *resp.AttachedPolicies[0].PolicyArn
-	return policyarn
-}
-
-func deleteUser(neptuneName string) {
+	if from != lifecycle.Stopped {
+		_, err = cloud.Neptune().StopDBCluster(&neptune.StopDBClusterInput{
+			DBClusterIdentifier: aws.String(name),
+		})
+		if err != nil {
+			if kerr := teardown.SetKeysActive(pool, name, true); kerr != nil {
+				fmt.Println(kerr.Error())
+			}
+			return deleteafter, "", err
+		}
+		fmt.Println("Stopping cluster " + name + " until it is deleted")
+	}
 
-	svc := iam.New(session.New(&aws.Config{
-		Region: aws.String(os.Getenv("REGION")),
-	}))
+	if finalSnapshot {
+		snapshot = finalSnapshotName(name)
+	}
 
-	params := &iam.DeleteUserInput{
-		UserName: aws.String(neptuneName), // Required
+	tx, err := pool.Begin()
+	if err != nil {
+		return deleteafter, "", err
 	}
-	_, err := svc.DeleteUser(params)
+	defer tx.Rollback()
 
+	err = lifecycle.Transition(tx, name, from, lifecycle.PendingDeletion)
 	if err != nil {
-		fmt.Println(err.Error())
+		return deleteafter, "", err
+	}
+	err = tx.QueryRow("UPDATE provision SET deleteafter=now() + $1 * interval '1 second', finalsnapshot=NULLIF($2, '') WHERE name=$3 RETURNING deleteafter", int64(retention().Seconds()), snapshot, name).Scan(&deleteafter)
+	if err != nil {
+		return deleteafter, "", err
+	}
+	return deleteafter, snapshot, tx.Commit()
+}
+
+// Bring back a soft deleted instance within its retention period, starting its cluster and
+// reactivating its access keys. It stays starting until the preprovisioner finds its cluster
+// available, so that its endpoint isn't handed out before it answers.
+func undeleteInstance(params martini.Params, r render.Render) {
+	name := params["name"]
+
+	if !instanceExists(name) {
+		fmt.Println("Instance with specified name does not exist in provision table")
+		r.Text(400, "Bad Request")
 		return
 	}
 
-}
+	var state string
+	var expired bool
+	err := pool.QueryRow("SELECT state, coalesce(deleteafter <= now(), false) FROM provision WHERE name=$1", name).Scan(&state, &expired)
+	if err != nil {
+		output500Error(r, err)
+		return
+	}
+	if state != lifecycle.PendingDeletion {
+		r.JSON(409, map[string]string{"error": "Instance is " + state + ", only instances pending deletion can be restored"})
+		return
+	}
+	if expired {
+		r.JSON(410, map[string]string{"error": "The retention period of the instance has ended"})
+		return
+	}
 
-func deleteAccessKey(neptuneName string) {
-	accesskeyid := getAccessKeyID(neptuneName)
+	_, err = cloud.Neptune().StartDBCluster(&neptune.StartDBClusterInput{
+		DBClusterIdentifier: aws.String(name),
+	})
+	if err != nil {
+		output500Error(r, err)
+		return
+	}
 
-	svc := iam.New(session.New(&aws.Config{
-		Region: aws.String(os.Getenv("REGION")),
-	}))
+	err = teardown.SetKeysActive(pool, name, true)
+	if err != nil {
+		output500Error(r, err)
+		return
+	}
 
-	params := &iam.DeleteAccessKeyInput{
-		AccessKeyId: aws.String(accesskeyid), // Required
-		UserName:    aws.String(neptuneName),
+	tx, err := pool.Begin()
+	if err != nil {
+		output500Error(r, err)
+		return
 	}
-	_, err := svc.DeleteAccessKey(params)
+	defer tx.Rollback()
 
+	err = lifecycle.Transition(tx, name, lifecycle.PendingDeletion, lifecycle.Starting)
+	if err == lifecycle.ErrStateChanged {
+		r.JSON(409, map[string]string{"error": err.Error()})
+		return
+	} else if err != nil {
+		output500Error(r, err)
+		return
+	}
+	_, err = tx.Exec("UPDATE provision SET deleteafter=NULL, finalsnapshot=NULL WHERE name=$1", name)
+	if err == nil {
+		err = tx.Commit()
+	}
 	if err != nil {
-		fmt.Println(err.Error())
+		output500Error(r, err)
 		return
 	}
 
+	r.JSON(202, map[string]string{"Response": "Instance restore in progress, it is claimed again once its cluster has started", "state": lifecycle.Starting})
 }
 
-func getAccessKeyID(neptuneName string) string {
+// Returns whether deletion protection is enabled for an instance
+func isProtected(name string) bool {
+	var protected bool
+	err := pool.QueryRow("SELECT deletionprotection FROM provision WHERE name=$1", name).Scan(&protected)
+	if err != nil {
+		fmt.Println(err.Error())
+	}
+	return protected
+}
 
-	svc := iam.New(session.New(&aws.Config{
-		Region: aws.String(os.Getenv("REGION")),
-	}))
+// Enable or disable deletion protection of the cluster of an instance
+func setDeletionProtection(name string, enabled bool) error {
+	svc := cloud.Neptune()
 
-	params := &iam.ListAccessKeysInput{
-		UserName: aws.String(neptuneName),
+	_, err := svc.ModifyDBCluster(&neptune.ModifyDBClusterInput{
+		DBClusterIdentifier: aws.String(name),
+		DeletionProtection:  aws.Bool(enabled),
+		ApplyImmediately:    aws.Bool(true),
+	})
+	if err != nil {
+		return err
 	}
-	resp, err := svc.ListAccessKeys(params)
 
+	_, err = pool.Exec("UPDATE provision SET deletionprotection=$1 WHERE name=$2", enabled, name)
+	return err
+}
+
+// Send a report of the drift between the provision table and AWS, without repairing it
+func getReconcileReport(r render.Render) {
+	report, err := reconcile.Run(pool, false)
 	if err != nil {
-		fmt.Println(err.Error())
+		output500Error(r, err)
+		return
 	}
+	r.JSON(200, report)
+}
 
-	accesskeyid := *resp.AccessKeyMetadata[0].AccessKeyId
-	return accesskeyid
+// IAM Helper Functions
 
+// Record teardown jobs for the IAM policy, access keys and user of a specified instance, and
+// those of its bindings. They are attempted once the response has been sent and retried by the
+// preprovisioner until they succeed.
+func queueIAM(neptuneName string) {
+	err := teardown.Enqueue(pool, neptuneName)
+	if err != nil {
+		fmt.Println("Unable to queue IAM teardown of " + neptuneName + ": " + err.Error())
+	}
 }
 
 // Helper Functions
 
 // Returns whether or not an instance is finished being created
 func isAvailable(name string) bool {
-	region := os.Getenv("REGION")
-
-	svc := neptune.New(session.New(&aws.Config{
-		Region: aws.String(region),
-	}))
+	svc := cloud.Neptune()
 
 	rparams := &neptune.DescribeDBInstancesInput{
 		DBInstanceIdentifier: aws.String(name),
@@ -423,6 +804,7 @@ func isAvailable(name string) bool {
 	rresp, rerr := svc.DescribeDBInstances(rparams)
 	if rerr != nil {
 		fmt.Println(rerr)
+		return false
 	}
 
 	fmt.Println("Checking to see if " + name + " is available...")
@@ -440,23 +822,67 @@ func output500Error(r render.Render, err error) {
 	r.JSON(500, map[string]interface{}{"error": err.Error()})
 }
 
-// Queries the database to provide information on an instance
-// Currently returns endpoint, will be expanded in the future to username and password
+// Queries the database to provide the endpoint and credentials of an instance, and AWS for the
+// reader endpoint of its cluster when it has replicas. A row without credentials or whose
+// cluster is gone from AWS is drift that reconcile reports and repairs.
 func getDBInfo(name string) (dbinfo dbspec, err error) {
 	dbinfo.Endpoint = queryDB("endpoint", name)
 	if dbinfo.Endpoint == "" {
-		return dbinfo, errors.New("Endpoint not available, try again in a few minutes")
+		return dbinfo, errEndpointPending
+	}
+
+	accesskey := queryDB("accesskey", name)
+	secretkey := queryDB("secretkey", name)
+	if accesskey == "" || secretkey == "" {
+		return dbinfo, errCredentialsMissing
 	}
 
-	dbinfo.AccessKeyID = queryDB("accesskey", name)
-	dbinfo.SecretAccessKey = queryDB("secretkey", name)
-	if dbinfo.AccessKeyID == "" || dbinfo.SecretAccessKey == "" {
-		return dbinfo, errors.New("Internal Server Error")
+	count, err := replicas.Active(pool, name)
+	if err != nil {
+		return dbinfo, err
+	}
+
+	resp, err := cloud.Neptune().DescribeDBClusters(&neptune.DescribeDBClustersInput{
+		DBClusterIdentifier: aws.String(name),
+	})
+	if teardown.IsNotFound(err) {
+		return dbinfo, errClusterNotFound
+	} else if err != nil {
+		if count > 0 {
+			return dbinfo, err
+		}
+		// Only a missing cluster is worth refusing the credentials for
+		fmt.Println(err)
+	} else if count > 0 {
+		dbinfo.ReaderEndpoint = readerEndpoint(resp.DBClusters[0])
+	}
+
+	// The access key ID and secret key are stored encrypted and only ever decrypted here
+	dbinfo.AccessKeyID, err = secrets.Decrypt(accesskey)
+	if err != nil {
+		return dbinfo, err
+	}
+	dbinfo.SecretAccessKey, err = secrets.Decrypt(secretkey)
+	if err != nil {
+		return dbinfo, err
 	}
 
 	return dbinfo, nil
 }
 
+// Outputs an error from getDBInfo, with a status that tells a caller whether to retry
+func outputDBInfoError(r render.Render, err error) {
+	switch err {
+	case errEndpointPending:
+		r.JSON(503, map[string]string{"error": err.Error()})
+	case errCredentialsMissing, errClusterNotFound:
+		fmt.Println(err)
+		r.JSON(409, map[string]string{"error": err.Error()})
+	default:
+		output500Error(r, err)
+	}
+}
+
 // Queries the database about a specific column of an instance
 func queryDB(i string, name string) string {
 	dberr := pool.QueryRow("select " + i + " from provision where name ='" + name + "'").Scan(&i)
@@ -486,7 +912,7 @@ func setupDB() *sql.DB {
 // Connect to the database and see if name exists in the provision table
 func instanceExists(name string) bool {
 	var exists bool
-	err := pool.QueryRow("SELECT EXISTS (SELECT FROM PROVISION WHERE name = $1)", name).Scan(&exists)
+	err := pool.QueryRow("SELECT EXISTS (SELECT FROM PROVISION WHERE name = $1 AND state <> $2)", name, lifecycle.Deleted).Scan(&exists)
 	if err != nil {
 		fmt.Println(err)
 		return false
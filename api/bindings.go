@@ -0,0 +1,161 @@
+package api
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	cloud "neptune-aws-api/cloud"
+	credentials "neptune-aws-api/credentials"
+	lifecycle "neptune-aws-api/lifecycle"
+	secrets "neptune-aws-api/secrets"
+	teardown "neptune-aws-api/teardown"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/neptune"
+	"github.com/go-martini/martini"
+	"github.com/martini-contrib/render"
+	uuid "github.com/nu7hatch/gouuid"
+)
+
+type bindingspec struct {
+	ID        string    `json:"id"`
+	Username  string    `json:"username"`
+	AccessKey string    `json:"accesskey"`
+	Created   time.Time `json:"created"`
+}
+
+// Create a separate IAM user, access key and policy for a claimed instance and send the new credentials as a response
+func createBinding(params martini.Params, r render.Render) {
+	name := params["name"]
+
+	if !instanceExists(name) {
+		fmt.Println("Instance with specified name does not exist in provision table")
+		r.Text(400, "Bad Request")
+		return
+	}
+
+	if queryDB("state", name) != lifecycle.Claimed {
+		r.JSON(409, map[string]string{"error": "Only claimed instances can be bound"})
+		return
+	}
+
+	id, user, err := newBinding(name, "", "")
+	if err != nil {
+		output500Error(r, err)
+		return
+	}
+
+	r.JSON(201, map[string]string{"id": id, "NEPTUNE_DATABASE_URL": queryDB("endpoint", name), "NEPTUNE_ACCESS_KEY": user.Accesskey, "NEPTUNE_SECRET_KEY": user.Secretkey, "NEPTUNE_REGION": os.Getenv("REGION")})
+}
+
+// Creates the IAM user, access key and policy of a new binding of an instance and records it.
+// Bindings made through the Open Service Broker API are recorded with their binding_id and
+// parameters, and keep their secret key, encrypted, so that repeated requests get the same
+// credentials.
+func newBinding(name string, osbid string, parameters string) (id string, user credentials.NeptuneUser, err error) {
+	resourceID, err := getClusterResourceID(name)
+	if err != nil {
+		return "", user, err
+	}
+
+	bindinguuid, _ := uuid.NewV4()
+	id = strings.Split(bindinguuid.String(), "-")[0]
+	username := name + "-" + id
+
+	fmt.Println("Creating binding " + id + " for " + name + "...")
+	user, err = credentials.Create(username, resourceID)
+	if err != nil {
+		return "", user, err
+	}
+
+	var secretkey string
+	accesskey, err := secrets.Encrypt(user.Accesskey)
+	if err == nil && osbid != "" {
+		secretkey, err = secrets.Encrypt(user.Secretkey)
+	}
+	if err == nil {
+		_, err = pool.Exec("INSERT INTO bindings(id, name, username, accesskey, osbid, parameters, secretkey) VALUES ($1, $2, $3, $4, NULLIF($5, ''), NULLIF($6, ''), NULLIF($7, ''))", id, name, username, accesskey, osbid, parameters, secretkey)
+	}
+	if err != nil {
+		credentials.Remove(username)
+		return "", user, err
+	}
+	return id, user, nil
+}
+
+// Send the bindings of an instance as a response, without their secret keys
+func listBindings(params martini.Params, r render.Render) {
+	name := params["name"]
+
+	if !instanceExists(name) {
+		fmt.Println("Instance with specified name does not exist in provision table")
+		r.Text(400, "Bad Request")
+		return
+	}
+
+	rows, err := pool.Query("SELECT id, username, coalesce(accesskey, ''), created FROM bindings WHERE name=$1 ORDER BY created", name)
+	if err != nil {
+		output500Error(r, err)
+		return
+	}
+	defer rows.Close()
+
+	bindings := []bindingspec{}
+	for rows.Next() {
+		var b bindingspec
+		err = rows.Scan(&b.ID, &b.Username, &b.AccessKey, &b.Created)
+		if err == nil {
+			b.AccessKey, err = secrets.Decrypt(b.AccessKey)
+		}
+		if err != nil {
+			output500Error(r, err)
+			return
+		}
+		bindings = append(bindings, b)
+	}
+	r.JSON(200, bindings)
+}
+
+// Revoke a single binding of an instance, leaving its other bindings untouched
+func deleteBinding(params martini.Params, r render.Render) {
+	name := params["name"]
+	id := params["id"]
+
+	var username string
+	err := pool.QueryRow("SELECT username FROM bindings WHERE id=$1 AND name=$2", id, name).Scan(&username)
+	if err == sql.ErrNoRows {
+		r.JSON(404, map[string]string{"error": "Binding does not exist"})
+		return
+	} else if err != nil {
+		output500Error(r, err)
+		return
+	}
+
+	done, err := teardown.Binding(pool, id, username)
+	if err != nil {
+		output500Error(r, err)
+		return
+	}
+	if !done {
+		r.JSON(202, map[string]string{"Response": "Binding deleted, its IAM user will be removed in the background"})
+		return
+	}
+
+	r.JSON(200, map[string]string{"Response": "Binding deleted"})
+}
+
+// Returns the resource ID that IAM policies use to refer to a cluster
+func getClusterResourceID(name string) (string, error) {
+	svc := cloud.Neptune()
+
+	resp, err := svc.DescribeDBClusters(&neptune.DescribeDBClustersInput{
+		DBClusterIdentifier: aws.String(name),
+	})
+	if err != nil {
+		return "", err
+	}
+	return *resp.DBClusters[0].DbClusterResourceId, nil
+}
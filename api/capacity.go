@@ -0,0 +1,125 @@
+package api
+
+import (
+	"fmt"
+	"time"
+
+	cloud "neptune-aws-api/cloud"
+	lifecycle "neptune-aws-api/lifecycle"
+	plans "neptune-aws-api/plans"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/aws/aws-sdk-go/service/neptune"
+	"github.com/go-martini/martini"
+	"github.com/martini-contrib/binding"
+	"github.com/martini-contrib/render"
+)
+
+// The capacity range of a serverless instance, in Neptune capacity units (NCUs)
+type capacityspec struct {
+	MinCapacity     *float64 `json:"min_capacity"`
+	MaxCapacity     *float64 `json:"max_capacity"`
+	CurrentCapacity *float64 `json:"current_capacity,omitempty"`
+}
+
+// Change the capacity range of a claimed serverless instance
+func setCapacity(spec capacityspec, berr binding.Errors, params martini.Params, r render.Render) {
+	name := params["name"]
+
+	if berr != nil || spec.MinCapacity == nil || spec.MaxCapacity == nil {
+		fmt.Println("Invalid JSON")
+		r.Text(400, "Bad Request")
+		return
+	}
+
+	if !instanceExists(name) {
+		fmt.Println("Instance with specified name does not exist in provision table")
+		r.Text(400, "Bad Request")
+		return
+	}
+
+	plan, err := plans.Get(queryDB("plan", name))
+	if err != nil {
+		output500Error(r, err)
+		return
+	}
+	if !plan.IsServerless() {
+		r.JSON(400, map[string]string{"error": "Instance is not on a serverless plan"})
+		return
+	}
+	err = plans.ValidCapacity(*spec.MinCapacity, *spec.MaxCapacity)
+	if err != nil {
+		r.JSON(400, map[string]string{"error": err.Error()})
+		return
+	}
+
+	state := queryDB("state", name)
+	if state != lifecycle.Claimed {
+		r.JSON(409, map[string]string{"error": "Instance is " + state + ", only claimed instances can change capacity"})
+		return
+	}
+
+	svc := cloud.Neptune()
+	_, err = svc.ModifyDBCluster(&neptune.ModifyDBClusterInput{
+		DBClusterIdentifier: aws.String(name),
+		ApplyImmediately:    aws.Bool(true),
+		ServerlessV2ScalingConfiguration: &neptune.ServerlessV2ScalingConfiguration{
+			MinCapacity: spec.MinCapacity,
+			MaxCapacity: spec.MaxCapacity,
+		},
+	})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == neptune.ErrCodeInvalidDBClusterStateFault {
+		r.JSON(409, map[string]string{"error": aerr.Message()})
+		return
+	} else if err != nil {
+		output500Error(r, err)
+		return
+	}
+
+	fmt.Println("Changed capacity of " + name + " to " + fmt.Sprint(*spec.MinCapacity) + "-" + fmt.Sprint(*spec.MaxCapacity) + " NCUs")
+	r.JSON(200, capacityspec{MinCapacity: spec.MinCapacity, MaxCapacity: spec.MaxCapacity})
+}
+
+// Returns the capacity range of a serverless cluster along with its most recent capacity, or nil
+// if the cluster isn't serverless. The current capacity is left out when CloudWatch can't be
+// read, it isn't worth failing the caller over.
+func getCapacity(cluster *neptune.DBCluster) *capacityspec {
+	config := cluster.ServerlessV2ScalingConfiguration
+	if config == nil {
+		return nil
+	}
+	capacity := &capacityspec{MinCapacity: config.MinCapacity, MaxCapacity: config.MaxCapacity}
+
+	end := time.Now().UTC()
+	resp, err := cloud.CloudWatch().GetMetricStatistics(&cloudwatch.GetMetricStatisticsInput{
+		Namespace:  aws.String("AWS/Neptune"),
+		MetricName: aws.String("ServerlessDatabaseCapacity"),
+		Dimensions: []*cloudwatch.Dimension{
+			{
+				Name:  aws.String("DBClusterIdentifier"),
+				Value: cluster.DBClusterIdentifier,
+			},
+		},
+		StartTime:  aws.Time(end.Add(-10 * time.Minute)),
+		EndTime:    aws.Time(end),
+		Period:     aws.Int64(60),
+		Statistics: []*string{aws.String(cloudwatch.StatisticAverage)},
+	})
+	if err != nil {
+		fmt.Println("Unable to get the capacity of " + aws.StringValue(cluster.DBClusterIdentifier) + ": " + err.Error())
+		return capacity
+	}
+
+	var latest *cloudwatch.Datapoint
+	for _, datapoint := range resp.Datapoints {
+		if latest == nil || aws.TimeValue(datapoint.Timestamp).After(aws.TimeValue(latest.Timestamp)) {
+			latest = datapoint
+		}
+	}
+	if latest != nil {
+		capacity.CurrentCapacity = latest.Average
+	}
+	return capacity
+}
@@ -0,0 +1,151 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	cloud "neptune-aws-api/cloud"
+	lifecycle "neptune-aws-api/lifecycle"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/neptune"
+	"github.com/go-martini/martini"
+	"github.com/martini-contrib/render"
+)
+
+type failoverspec struct {
+	PreviousWriter string `json:"previous_writer"`
+	Writer         string `json:"writer"`
+	ClusterStatus  string `json:"cluster_status"`
+	Endpoint       string `json:"endpoint"`
+}
+
+// Fail the cluster of a claimed instance over to one of its readers, the one given with
+// ?target= or else the available reader with the highest priority. The instance endpoint is
+// switched to the cluster endpoint, which follows the writer.
+func failoverInstance(params martini.Params, r render.Render, req *http.Request) {
+	name := params["name"]
+	target := req.URL.Query().Get("target")
+
+	if !instanceExists(name) {
+		fmt.Println("Instance with specified name does not exist in provision table")
+		r.Text(400, "Bad Request")
+		return
+	}
+
+	state := queryDB("state", name)
+	if state != lifecycle.Claimed {
+		r.JSON(409, map[string]string{"error": "Instance is " + state + ", only claimed instances can fail over"})
+		return
+	}
+
+	svc := cloud.Neptune()
+	resp, err := svc.DescribeDBClusters(&neptune.DescribeDBClustersInput{
+		DBClusterIdentifier: aws.String(name),
+	})
+	if err != nil {
+		output500Error(r, err)
+		return
+	}
+	cluster := resp.DBClusters[0]
+
+	var writer string
+	for _, m := range cluster.DBClusterMembers {
+		if aws.BoolValue(m.IsClusterWriter) {
+			writer = aws.StringValue(m.DBInstanceIdentifier)
+		}
+	}
+	if target == "" {
+		target = failoverTarget(name, cluster)
+		if target == "" {
+			r.JSON(409, map[string]string{"error": "Instance has no available replica to fail over to"})
+			return
+		}
+	} else if target == writer {
+		r.JSON(409, map[string]string{"error": target + " is already the writer"})
+		return
+	} else if !isReader(name, cluster, target) {
+		r.JSON(400, map[string]string{"error": target + " is not an available replica of the instance"})
+		return
+	}
+
+	failover, err := svc.FailoverDBCluster(&neptune.FailoverDBClusterInput{
+		DBClusterIdentifier:        aws.String(name),
+		TargetDBInstanceIdentifier: aws.String(target),
+	})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == neptune.ErrCodeInvalidDBClusterStateFault {
+		r.JSON(409, map[string]string{"error": aerr.Message()})
+		return
+	} else if err != nil {
+		output500Error(r, err)
+		return
+	}
+
+	endpoint := writerEndpoint(failover.DBCluster)
+	_, err = pool.Exec("UPDATE provision SET endpoint=$1 WHERE name=$2", endpoint, name)
+	if err != nil {
+		output500Error(r, err)
+		return
+	}
+
+	fmt.Println("Failing over " + name + " from " + writer + " to " + target)
+	r.JSON(202, failoverspec{
+		PreviousWriter: writer,
+		Writer:         target,
+		ClusterStatus:  aws.StringValue(failover.DBCluster.Status),
+		Endpoint:       endpoint,
+	})
+}
+
+// Returns the reader of a cluster that a failover promotes, the available one with the lowest
+// promotion tier, or an empty string if there is none
+func failoverTarget(name string, cluster *neptune.DBCluster) string {
+	var target *neptune.DBClusterMember
+	for _, m := range cluster.DBClusterMembers {
+		if aws.BoolValue(m.IsClusterWriter) || !isReader(name, cluster, aws.StringValue(m.DBInstanceIdentifier)) {
+			continue
+		}
+		if target == nil || aws.Int64Value(m.PromotionTier) < aws.Int64Value(target.PromotionTier) {
+			target = m
+		}
+	}
+	if target == nil {
+		return ""
+	}
+	return aws.StringValue(target.DBInstanceIdentifier)
+}
+
+// Returns whether id is a reader of the cluster of an instance that can be promoted, either
+// an available replica or, after an earlier failover, the instance itself
+func isReader(name string, cluster *neptune.DBCluster, id string) bool {
+	member := false
+	for _, m := range cluster.DBClusterMembers {
+		if aws.StringValue(m.DBInstanceIdentifier) == id && !aws.BoolValue(m.IsClusterWriter) {
+			member = true
+		}
+	}
+	if !member {
+		return false
+	}
+	if id == name {
+		return true
+	}
+
+	var exists bool
+	err := pool.QueryRow("SELECT EXISTS (SELECT FROM replicas WHERE id=$1 AND name=$2 AND status='available')", id, name).Scan(&exists)
+	if err != nil {
+		fmt.Println(err)
+		return false
+	}
+	return exists
+}
+
+// Returns the endpoint of a cluster that always points at its writer
+func writerEndpoint(cluster *neptune.DBCluster) string {
+	if cluster.Endpoint == nil {
+		return ""
+	}
+	return *cluster.Endpoint + ":" + strconv.FormatInt(aws.Int64Value(cluster.Port), 10)
+}
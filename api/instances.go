@@ -0,0 +1,356 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	cloud "neptune-aws-api/cloud"
+	lifecycle "neptune-aws-api/lifecycle"
+	teardown "neptune-aws-api/teardown"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/neptune"
+	"github.com/go-martini/martini"
+	"github.com/martini-contrib/render"
+)
+
+// The state of an instance as recorded by the broker and as reported by AWS. It never
+// includes credentials, use /v1/neptune/url/:name for those.
+type instancespec struct {
+	Name                 string            `json:"name"`
+	Plan                 string            `json:"plan"`
+	PendingPlan          string            `json:"pending_plan,omitempty"`
+	Billingcode          string            `json:"billingcode,omitempty"`
+	State                string            `json:"state"`
+	Status               string            `json:"status"`
+	ClusterStatus        string            `json:"cluster_status"`
+	Endpoint             string            `json:"endpoint,omitempty"`
+	ReaderEndpoint       string            `json:"reader_endpoint,omitempty"`
+	Writer               string            `json:"writer,omitempty"`
+	MultiAZ              bool              `json:"multi_az"`
+	Replicas             []replicaspec     `json:"replicas"`
+	InstanceClass        string            `json:"instance_class,omitempty"`
+	Serverless           *capacityspec     `json:"serverless,omitempty"`
+	EngineVersion        string            `json:"engine_version,omitempty"`
+	PendingModifications map[string]string `json:"pending_modifications"`
+	StorageEncrypted     bool              `json:"storage_encrypted"`
+	IAMAuth              bool              `json:"iam_auth"`
+	DeletionProtection   bool              `json:"deletion_protection"`
+	Tags                 map[string]string `json:"tags"`
+	Created              *time.Time        `json:"created,omitempty"`
+}
+
+// Report the lifecycle state of an instance together with the live state of its cluster and
+// instance in AWS
+func getInstanceStatus(params martini.Params, r render.Render) {
+	name := params["name"]
+
+	status := instancespec{
+		Name:                 name,
+		Status:               "not found",
+		ClusterStatus:        "not found",
+		PendingModifications: map[string]string{},
+		Tags:                 map[string]string{},
+	}
+	err := pool.QueryRow("SELECT plan, coalesce(billingcode, ''), state, coalesce(endpoint, ''), deletionprotection FROM provision WHERE name=$1", name).Scan(&status.Plan, &status.Billingcode, &status.State, &status.Endpoint, &status.DeletionProtection)
+	if err == sql.ErrNoRows {
+		r.JSON(404, map[string]string{"error": "Instance does not exist"})
+		return
+	} else if err != nil {
+		output500Error(r, err)
+		return
+	}
+	status.PendingPlan = pendingPlan(name)
+	status.Replicas, err = getReplicas(name)
+	if err != nil {
+		output500Error(r, err)
+		return
+	}
+
+	svc := cloud.Neptune()
+
+	clusters, err := svc.DescribeDBClusters(&neptune.DescribeDBClustersInput{
+		DBClusterIdentifier: aws.String(name),
+	})
+	if err != nil && !teardown.IsNotFound(err) {
+		output500Error(r, err)
+		return
+	}
+	if err == nil && len(clusters.DBClusters) > 0 {
+		cluster := clusters.DBClusters[0]
+		status.ClusterStatus = aws.StringValue(cluster.Status)
+		status.ReaderEndpoint = readerEndpoint(cluster)
+		status.MultiAZ = aws.BoolValue(cluster.MultiAZ)
+		for _, m := range cluster.DBClusterMembers {
+			if aws.BoolValue(m.IsClusterWriter) {
+				status.Writer = aws.StringValue(m.DBInstanceIdentifier)
+			}
+		}
+		status.Serverless = getCapacity(cluster)
+		status.EngineVersion = aws.StringValue(cluster.EngineVersion)
+		status.StorageEncrypted = aws.BoolValue(cluster.StorageEncrypted)
+		status.IAMAuth = aws.BoolValue(cluster.IAMDatabaseAuthenticationEnabled)
+		status.DeletionProtection = aws.BoolValue(cluster.DeletionProtection)
+		status.Created = cluster.ClusterCreateTime
+		if pending := cluster.PendingModifiedValues; pending != nil {
+			addPending(status.PendingModifications, "engine_version", pending.EngineVersion)
+			if pending.IAMDatabaseAuthenticationEnabled != nil {
+				status.PendingModifications["iam_auth"] = strconv.FormatBool(*pending.IAMDatabaseAuthenticationEnabled)
+			}
+		}
+	}
+
+	instances, err := svc.DescribeDBInstances(&neptune.DescribeDBInstancesInput{
+		DBInstanceIdentifier: aws.String(name),
+	})
+	if err != nil && !teardown.IsNotFound(err) {
+		output500Error(r, err)
+		return
+	}
+	if err == nil && len(instances.DBInstances) > 0 {
+		instance := instances.DBInstances[0]
+		status.Status = aws.StringValue(instance.DBInstanceStatus)
+		status.InstanceClass = aws.StringValue(instance.DBInstanceClass)
+		if instance.InstanceCreateTime != nil {
+			status.Created = instance.InstanceCreateTime
+		}
+		if pending := instance.PendingModifiedValues; pending != nil {
+			addPending(status.PendingModifications, "instance_class", pending.DBInstanceClass)
+			addPending(status.PendingModifications, "engine_version", pending.EngineVersion)
+		}
+
+		tags, err := svc.ListTagsForResource(&neptune.ListTagsForResourceInput{
+			ResourceName: instance.DBInstanceArn,
+		})
+		if err != nil {
+			output500Error(r, err)
+			return
+		}
+		for _, tag := range tags.TagList {
+			status.Tags[aws.StringValue(tag.Key)] = aws.StringValue(tag.Value)
+		}
+	}
+
+	r.JSON(200, status)
+}
+
+func addPending(pending map[string]string, key string, value *string) {
+	if value != nil {
+		pending[key] = *value
+	}
+}
+
+// An instance as listed by /v1/neptune/instances
+type instancesummary struct {
+	Name               string    `json:"name"`
+	Plan               string    `json:"plan"`
+	Billingcode        string    `json:"billingcode,omitempty"`
+	State              string    `json:"state"`
+	Endpoint           string    `json:"endpoint,omitempty"`
+	Source             string    `json:"source,omitempty"`
+	DeletionProtection bool      `json:"deletion_protection"`
+	Created            time.Time `json:"created"`
+}
+
+type instancelist struct {
+	Instances  []instancesummary `json:"instances"`
+	NextCursor string            `json:"next_cursor,omitempty"`
+}
+
+const (
+	defaultPageSize = 50
+	maxPageSize     = 500
+)
+
+// Sort keys of instances, as text so that a cursor can hold any of them. The name is appended
+// to every sort so that the cursor identifies a single row.
+var instanceSorts = map[string]string{
+	"name":    "p.name",
+	"created": "coalesce(to_char(p.makedate, 'YYYY-MM-DD HH24:MI:SS.US'), '')",
+	"plan":    "coalesce(p.plan, '')",
+	"state":   "p.state",
+}
+
+// The format makedate is compared in, it has no time zone and is recorded in America/Denver
+const makedateFormat = "2006-01-02 15:04:05.000000"
+
+// List the instances in the provision table. Deleted instances are left out unless they are
+// asked for with state=deleted.
+//
+// Filters: plan, state (comma separated), claimed=true|false, billingcode, tag=key or
+// tag=key:value (repeatable), created_after and created_before (RFC 3339).
+// Sorting: sort=name|created|plan|state and order=asc|desc. Pagination: limit and cursor, which
+// is the next_cursor of the previous page.
+func listInstances(req *http.Request, r render.Render) {
+	stmt, args, sortName, limit, err := instancesQuery(req.URL.Query())
+	if err != nil {
+		r.JSON(400, map[string]string{"error": err.Error()})
+		return
+	}
+
+	rows, err := pool.Query(stmt, args...)
+	if err != nil {
+		output500Error(r, err)
+		return
+	}
+	defer rows.Close()
+
+	list := instancelist{Instances: []instancesummary{}}
+	for rows.Next() {
+		var i instancesummary
+		err = rows.Scan(&i.Name, &i.Plan, &i.Billingcode, &i.State, &i.Endpoint, &i.Source, &i.DeletionProtection, &i.Created)
+		if err != nil {
+			output500Error(r, err)
+			return
+		}
+		list.Instances = append(list.Instances, i)
+	}
+	if err = rows.Err(); err != nil {
+		output500Error(r, err)
+		return
+	}
+
+	if len(list.Instances) > limit {
+		list.Instances = list.Instances[:limit]
+		last := list.Instances[limit-1]
+		list.NextCursor = encodeCursor(sortValue(sortName, last), last.Name)
+	}
+	r.JSON(200, list)
+}
+
+// Builds the query of listInstances from the parameters of a request. It selects one instance
+// more than the limit, to tell whether there is a next page. Errors are about the parameters.
+func instancesQuery(query url.Values) (stmt string, args []interface{}, sortName string, limit int, err error) {
+	var where []string
+	arg := func(value interface{}) string {
+		args = append(args, value)
+		return "$" + strconv.Itoa(len(args))
+	}
+
+	if plan := query.Get("plan"); plan != "" {
+		where = append(where, "p.plan = "+arg(plan))
+	}
+	if states := query.Get("state"); states != "" {
+		var placeholders []string
+		for _, state := range strings.Split(states, ",") {
+			placeholders = append(placeholders, arg(state))
+		}
+		where = append(where, "p.state IN ("+strings.Join(placeholders, ", ")+")")
+	} else {
+		where = append(where, "p.state <> "+arg(lifecycle.Deleted))
+	}
+	switch query.Get("claimed") {
+	case "":
+	case "true":
+		where = append(where, "p.state IN ("+arg(lifecycle.Claimed)+", "+arg(lifecycle.Stopped)+", "+arg(lifecycle.Starting)+", "+arg(lifecycle.PendingDeletion)+")")
+	case "false":
+		where = append(where, "p.state IN ("+arg(lifecycle.Creating)+", "+arg(lifecycle.IAMPending)+", "+arg(lifecycle.Available)+")")
+	default:
+		return "", nil, "", 0, errors.New("claimed must be true or false")
+	}
+	if billingcode := query.Get("billingcode"); billingcode != "" {
+		where = append(where, "p.billingcode = "+arg(billingcode))
+	}
+	for _, tag := range query["tag"] {
+		parts := strings.SplitN(tag, ":", 2)
+		key := arg(parts[0])
+		if len(parts) == 1 {
+			where = append(where, "(EXISTS (SELECT FROM tags t WHERE t.name = p.name AND t.key = "+key+") OR ("+key+" = 'billingcode' AND p.billingcode IS NOT NULL))")
+			continue
+		}
+		value := arg(parts[1])
+		// The billingcode tag is added when an instance is claimed and kept in its own column
+		where = append(where, "(EXISTS (SELECT FROM tags t WHERE t.name = p.name AND t.key = "+key+" AND t.value = "+value+") OR ("+key+" = 'billingcode' AND p.billingcode = "+value+"))")
+	}
+	for _, bound := range []struct{ param, op string }{{"created_after", ">="}, {"created_before", "<"}} {
+		if value := query.Get(bound.param); value != "" {
+			t, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				return "", nil, "", 0, errors.New(bound.param + " must be an RFC 3339 timestamp")
+			}
+			where = append(where, "p.makedate "+bound.op+" "+arg(t.In(makedateLocation()).Format(makedateFormat))+"::timestamp")
+		}
+	}
+
+	sortName = query.Get("sort")
+	if sortName == "" {
+		sortName = "name"
+	}
+	sortKey, ok := instanceSorts[sortName]
+	if !ok {
+		return "", nil, "", 0, errors.New("sort must be one of name, created, plan or state")
+	}
+	direction, cmp := "ASC", ">"
+	switch query.Get("order") {
+	case "", "asc":
+	case "desc":
+		direction, cmp = "DESC", "<"
+	default:
+		return "", nil, "", 0, errors.New("order must be asc or desc")
+	}
+
+	limit = defaultPageSize
+	if value := query.Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > maxPageSize {
+			return "", nil, "", 0, errors.New("limit must be between 1 and " + strconv.Itoa(maxPageSize))
+		}
+		limit = n
+	}
+
+	if cursor := query.Get("cursor"); cursor != "" {
+		after, name, err := decodeCursor(cursor)
+		if err != nil {
+			return "", nil, "", 0, err
+		}
+		where = append(where, "("+sortKey+", p.name) "+cmp+" ("+arg(after)+", "+arg(name)+")")
+	}
+
+	stmt = "SELECT p.name, coalesce(p.plan, ''), coalesce(p.billingcode, ''), p.state, coalesce(p.endpoint, ''), coalesce(p.source, ''), p.deletionprotection, p.makedate FROM provision p WHERE " + strings.Join(where, " AND ") + " ORDER BY " + sortKey + " " + direction + ", p.name " + direction + " LIMIT " + arg(limit+1)
+	return stmt, args, sortName, limit, nil
+}
+
+// Returns the value of the sort key of an instance, as it is compared in SQL
+func sortValue(sort string, i instancesummary) string {
+	switch sort {
+	case "created":
+		return i.Created.Format(makedateFormat)
+	case "plan":
+		return i.Plan
+	case "state":
+		return i.State
+	}
+	return i.Name
+}
+
+// A cursor is the sort key and name of the last instance of a page
+func encodeCursor(value string, name string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(value + "\x00" + name))
+}
+
+func decodeCursor(cursor string) (value string, name string, err error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return "", "", errors.New("Invalid cursor")
+	}
+	parts := strings.SplitN(string(raw), "\x00", 2)
+	if len(parts) != 2 {
+		return "", "", errors.New("Invalid cursor")
+	}
+	return parts[0], parts[1], nil
+}
+
+// Returns the time zone makedate is recorded in
+func makedateLocation() *time.Location {
+	location, err := time.LoadLocation("America/Denver")
+	if err != nil {
+		return time.UTC
+	}
+	return location
+}
@@ -0,0 +1,100 @@
+package api
+
+import (
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCursorRoundTrip(t *testing.T) {
+	i := instancesummary{
+		Name:    "neptune-0001",
+		Plan:    "small",
+		State:   "claimed",
+		Created: time.Date(2020, 1, 2, 3, 4, 5, 6000, time.UTC),
+	}
+	tests := []struct {
+		sort string
+		want string
+	}{
+		{"name", "neptune-0001"},
+		{"", "neptune-0001"},
+		{"plan", "small"},
+		{"state", "claimed"},
+		{"created", "2020-01-02 03:04:05.000006"},
+	}
+	for _, tt := range tests {
+		value := sortValue(tt.sort, i)
+		if value != tt.want {
+			t.Errorf("sortValue(%q) = %q, expected %q", tt.sort, value, tt.want)
+		}
+		gotValue, gotName, err := decodeCursor(encodeCursor(value, i.Name))
+		if err != nil {
+			t.Errorf("decoding cursor sorted by %q: %s", tt.sort, err)
+			continue
+		}
+		if gotValue != value || gotName != i.Name {
+			t.Errorf("cursor sorted by %q decoded to %q, %q", tt.sort, gotValue, gotName)
+		}
+	}
+}
+
+func TestDecodeCursorInvalid(t *testing.T) {
+	for _, cursor := range []string{"!!!", "bm9uYW1l"} {
+		if _, _, err := decodeCursor(cursor); err == nil {
+			t.Errorf("decodeCursor(%q) succeeded", cursor)
+		}
+	}
+}
+
+func TestInstancesQuery(t *testing.T) {
+	stmt, args, sortName, limit, err := instancesQuery(url.Values{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(stmt, " FROM provision p WHERE p.state <> $1 ORDER BY p.name ASC, p.name ASC LIMIT $2") {
+		t.Errorf("default query is %s", stmt)
+	}
+	if !reflect.DeepEqual(args, []interface{}{"deleted", defaultPageSize + 1}) || sortName != "name" || limit != defaultPageSize {
+		t.Errorf("default query has args %v, sort %s and limit %d", args, sortName, limit)
+	}
+
+	cursor := encodeCursor("small", "neptune-0001")
+	stmt, args, sortName, limit, err = instancesQuery(url.Values{
+		"tag":    {"team:graph", "billingcode"},
+		"sort":   {"plan"},
+		"order":  {"desc"},
+		"limit":  {"10"},
+		"cursor": {cursor},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	where := []string{
+		"p.state <> $1",
+		"(EXISTS (SELECT FROM tags t WHERE t.name = p.name AND t.key = $2 AND t.value = $3) OR ($2 = 'billingcode' AND p.billingcode = $3))",
+		"(EXISTS (SELECT FROM tags t WHERE t.name = p.name AND t.key = $4) OR ($4 = 'billingcode' AND p.billingcode IS NOT NULL))",
+		"(coalesce(p.plan, ''), p.name) < ($5, $6)",
+	}
+	if !strings.Contains(stmt, " WHERE "+strings.Join(where, " AND ")+" ORDER BY coalesce(p.plan, '') DESC, p.name DESC LIMIT $7") {
+		t.Errorf("filtered query is %s", stmt)
+	}
+	if !reflect.DeepEqual(args, []interface{}{"deleted", "team", "graph", "billingcode", "small", "neptune-0001", 11}) || sortName != "plan" || limit != 10 {
+		t.Errorf("filtered query has args %v, sort %s and limit %d", args, sortName, limit)
+	}
+
+	for _, query := range []url.Values{
+		{"sort": {"billingcode"}},
+		{"order": {"up"}},
+		{"limit": {"0"}},
+		{"claimed": {"maybe"}},
+		{"created_after": {"yesterday"}},
+		{"cursor": {"!!!"}},
+	} {
+		if _, _, _, _, err := instancesQuery(query); err == nil {
+			t.Errorf("instancesQuery(%v) succeeded", query)
+		}
+	}
+}
@@ -0,0 +1,365 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	lifecycle "neptune-aws-api/lifecycle"
+	plans "neptune-aws-api/plans"
+	secrets "neptune-aws-api/secrets"
+	teardown "neptune-aws-api/teardown"
+
+	"github.com/go-martini/martini"
+	"github.com/martini-contrib/binding"
+	"github.com/martini-contrib/render"
+)
+
+// Open Service Broker API v2 (https://github.com/openservicebrokerapi/servicebroker)
+
+const osbServiceID = "akkeris-neptune"
+
+type osbprovisionspec struct {
+	ServiceID        string                 `json:"service_id"`
+	PlanID           string                 `json:"plan_id"`
+	OrganizationGUID string                 `json:"organization_guid"`
+	SpaceGUID        string                 `json:"space_guid"`
+	Parameters       map[string]interface{} `json:"parameters"`
+}
+
+// The parts of a bind request that must match for a repeated request to get the same binding
+type osbbindspec struct {
+	ServiceID    string                 `json:"service_id"`
+	PlanID       string                 `json:"plan_id"`
+	AppGUID      string                 `json:"app_guid,omitempty"`
+	BindResource map[string]interface{} `json:"bind_resource,omitempty"`
+	Parameters   map[string]interface{} `json:"parameters,omitempty"`
+}
+
+type osbplan struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Free        bool   `json:"free"`
+}
+
+type osbservice struct {
+	ID             string    `json:"id"`
+	Name           string    `json:"name"`
+	Description    string    `json:"description"`
+	Bindable       bool      `json:"bindable"`
+	PlanUpdateable bool      `json:"plan_updateable"`
+	Tags           []string  `json:"tags"`
+	Plans          []osbplan `json:"plans"`
+}
+
+// Send the service catalog, built from the same plans as /v1/neptune/plans
+func getCatalog(r render.Render) {
+	var osbplans []osbplan
+	for _, name := range plans.Names() {
+		plan, _ := plans.Get(name)
+		osbplans = append(osbplans, osbplan{
+			ID:          osbPlanID(name),
+			Name:        name,
+			Description: plan.Summary(),
+			Free:        false,
+		})
+	}
+
+	r.JSON(200, map[string]interface{}{"services": []osbservice{{
+		ID:             osbServiceID,
+		Name:           "neptune",
+		Description:    "AWS Neptune graph database",
+		Bindable:       true,
+		PlanUpdateable: false,
+		Tags:           []string{"neptune", "graph", "gremlin", "sparql"},
+		Plans:          osbplans,
+	}}})
+}
+
+// Claim a preprovisioned instance for an Open Service Broker service instance. Claiming is
+// synchronous, only a repeated request for an instance that isn't ready yet is asynchronous.
+func provisionServiceInstance(params martini.Params, spec osbprovisionspec, berr binding.Errors, req *http.Request, r render.Render) {
+	instanceID := params["instance_id"]
+
+	if berr != nil {
+		fmt.Println(berr)
+		outputOSBError(r, 400, "Bad Request")
+		return
+	}
+
+	plan := strings.TrimPrefix(spec.PlanID, osbServiceID+"-")
+	if _, err := plans.Get(plan); err != nil || spec.ServiceID != osbServiceID {
+		fmt.Println("Invalid service or plan")
+		outputOSBError(r, 400, "Unknown service_id or plan_id")
+		return
+	}
+
+	billingcode, _ := spec.Parameters["billingcode"].(string)
+	if billingcode == "" {
+		billingcode = spec.OrganizationGUID
+	}
+	if billingcode == "" {
+		fmt.Println("Missing billingcode")
+		outputOSBError(r, 400, "A billingcode parameter is required")
+		return
+	}
+
+	name, err := getInstanceName(instanceID)
+	if err == nil {
+		if queryDB("plan", name) != plan {
+			outputOSBError(r, 409, "Service instance already exists with a different plan")
+			return
+		}
+		switch queryDB("state", name) {
+		case lifecycle.Creating, lifecycle.IAMPending, lifecycle.Starting:
+			if !acceptsIncomplete(req) {
+				outputOSBAsyncRequired(r)
+				return
+			}
+			r.JSON(202, map[string]interface{}{})
+		default:
+			r.JSON(200, map[string]interface{}{})
+		}
+		return
+	} else if err != sql.ErrNoRows {
+		outputOSBError(r, 500, err.Error())
+		return
+	}
+
+	pending, err := isPendingDeletion(instanceID)
+	if err != nil {
+		outputOSBError(r, 500, err.Error())
+		return
+	}
+	if pending {
+		outputOSBError(r, 409, "Service instance has been deleted and is pending deletion")
+		return
+	}
+
+	name, err = claim(plan, billingcode, instanceID)
+	if err == errNoInstances {
+		outputOSBError(r, 503, err.Error())
+		return
+	} else if err != nil {
+		outputOSBError(r, 500, err.Error())
+		return
+	}
+
+	fmt.Println("Claimed " + name + " for service instance " + instanceID)
+	r.JSON(201, map[string]interface{}{})
+}
+
+// Delete the instance backing an Open Service Broker service instance. An instance that is
+// already being deleted is only reported as in progress to platforms that accept that.
+func deprovisionServiceInstance(params martini.Params, req *http.Request, r render.Render) {
+	instanceID := params["instance_id"]
+
+	name, err := getInstanceName(instanceID)
+	if err == sql.ErrNoRows {
+		r.JSON(410, map[string]interface{}{})
+		return
+	} else if err != nil {
+		outputOSBError(r, 500, err.Error())
+		return
+	}
+
+	state := queryDB("state", name)
+	if state == lifecycle.Starting {
+		outputOSBError(r, 422, "Instance is starting, delete it once it has started")
+		return
+	}
+	if state == lifecycle.Claimed || state == lifecycle.Stopped {
+		_, _, err = softDelete(name, state, false)
+		if err == errProtected {
+			outputOSBError(r, 422, err.Error())
+			return
+		} else if err != nil {
+			outputOSBError(r, 500, err.Error())
+			return
+		}
+		r.JSON(200, map[string]interface{}{})
+		return
+	}
+
+	_, err = destroy(name, false)
+	if err == errDeleting {
+		if !acceptsIncomplete(req) {
+			outputOSBAsyncRequired(r)
+			return
+		}
+		r.JSON(202, map[string]interface{}{})
+		return
+	} else if err == errProtected {
+		outputOSBError(r, 422, err.Error())
+		return
+	} else if err != nil {
+		outputOSBError(r, 500, err.Error())
+		return
+	}
+
+	queueIAM(name)
+
+	r.JSON(200, map[string]interface{}{})
+
+	teardown.Finish(pool, name)
+}
+
+// Report whether the instance backing a service instance is ready for use
+func getLastOperation(params martini.Params, r render.Render) {
+	name, err := getInstanceName(params["instance_id"])
+	if err == sql.ErrNoRows {
+		r.JSON(410, map[string]interface{}{})
+		return
+	} else if err != nil {
+		outputOSBError(r, 500, err.Error())
+		return
+	}
+
+	state := queryDB("state", name)
+	switch state {
+	case lifecycle.Available, lifecycle.Claimed, lifecycle.Stopped:
+		r.JSON(200, map[string]string{"state": "succeeded"})
+	case lifecycle.Failed:
+		r.JSON(200, map[string]string{"state": "failed", "description": "Instance is " + state})
+	default:
+		r.JSON(200, map[string]string{"state": "in progress", "description": "Instance is " + state})
+	}
+}
+
+// Create a binding of the instance backing a service instance, with its own IAM user and
+// access key, and send its credentials. Binding again with the same binding_id and parameters
+// sends the same credentials.
+func bindServiceInstance(params martini.Params, spec osbbindspec, berr binding.Errors, r render.Render) {
+	bindingID := params["binding_id"]
+
+	if berr != nil {
+		fmt.Println(berr)
+		outputOSBError(r, 400, "Bad Request")
+		return
+	}
+
+	name, err := getInstanceName(params["instance_id"])
+	if err == sql.ErrNoRows {
+		outputOSBError(r, 404, "Service instance does not exist")
+		return
+	} else if err != nil {
+		outputOSBError(r, 500, err.Error())
+		return
+	}
+
+	encoded, err := json.Marshal(spec)
+	if err != nil {
+		outputOSBError(r, 500, err.Error())
+		return
+	}
+	parameters := string(encoded)
+
+	var existingName, existingParameters, accesskey, secretkey string
+	err = pool.QueryRow("SELECT name, coalesce(parameters, ''), coalesce(accesskey, ''), coalesce(secretkey, '') FROM bindings WHERE osbid=$1", bindingID).Scan(&existingName, &existingParameters, &accesskey, &secretkey)
+	if err == nil {
+		if existingName != name || existingParameters != parameters {
+			outputOSBError(r, 409, "Service binding already exists with different parameters")
+			return
+		}
+		accesskey, err = secrets.Decrypt(accesskey)
+		if err == nil {
+			secretkey, err = secrets.Decrypt(secretkey)
+		}
+		if err != nil {
+			outputOSBError(r, 500, err.Error())
+			return
+		}
+		r.JSON(200, osbCredentials(name, accesskey, secretkey))
+		return
+	} else if err != sql.ErrNoRows {
+		outputOSBError(r, 500, err.Error())
+		return
+	}
+
+	if state := queryDB("state", name); state != lifecycle.Claimed {
+		outputOSBError(r, 422, "Instance is "+state+", only claimed instances can be bound")
+		return
+	}
+
+	_, user, err := newBinding(name, bindingID, parameters)
+	if err != nil {
+		outputOSBError(r, 500, err.Error())
+		return
+	}
+
+	r.JSON(201, osbCredentials(name, user.Accesskey, user.Secretkey))
+}
+
+func osbCredentials(name string, accesskey string, secretkey string) map[string]interface{} {
+	return map[string]interface{}{"credentials": map[string]string{"NEPTUNE_DATABASE_URL": queryDB("endpoint", name), "NEPTUNE_ACCESS_KEY": accesskey, "NEPTUNE_SECRET_KEY": secretkey, "NEPTUNE_REGION": os.Getenv("REGION")}}
+}
+
+// Revoke a binding of the instance backing a service instance, removing its IAM user
+func unbindServiceInstance(params martini.Params, r render.Render) {
+	name, err := getInstanceName(params["instance_id"])
+	if err == sql.ErrNoRows {
+		r.JSON(410, map[string]interface{}{})
+		return
+	} else if err != nil {
+		outputOSBError(r, 500, err.Error())
+		return
+	}
+
+	var id, username string
+	err = pool.QueryRow("SELECT id, username FROM bindings WHERE osbid=$1 AND name=$2", params["binding_id"], name).Scan(&id, &username)
+	if err == sql.ErrNoRows {
+		r.JSON(410, map[string]interface{}{})
+		return
+	} else if err != nil {
+		outputOSBError(r, 500, err.Error())
+		return
+	}
+
+	// A failed IAM teardown is retried in the background, the binding is gone either way
+	_, err = teardown.Binding(pool, id, username)
+	if err != nil {
+		outputOSBError(r, 500, err.Error())
+		return
+	}
+	r.JSON(200, map[string]interface{}{})
+}
+
+// Look up the provision row claimed for a service instance. Soft deleted instances are gone as
+// far as the platform is concerned, they can only be brought back through /v1.
+func getInstanceName(instanceID string) (name string, err error) {
+	err = pool.QueryRow("SELECT name FROM provision WHERE instanceid=$1 AND state NOT IN ($2, $3)", instanceID, lifecycle.Deleted, lifecycle.PendingDeletion).Scan(&name)
+	return name, err
+}
+
+// Returns whether the instance of a service instance has been soft deleted
+func isPendingDeletion(instanceID string) (bool, error) {
+	var pending bool
+	err := pool.QueryRow("SELECT EXISTS (SELECT FROM provision WHERE instanceid=$1 AND state=$2)", instanceID, lifecycle.PendingDeletion).Scan(&pending)
+	return pending, err
+}
+
+// Returns whether the platform accepts an asynchronous response to a request
+func acceptsIncomplete(req *http.Request) bool {
+	return req.URL.Query().Get("accepts_incomplete") == "true"
+}
+
+func osbPlanID(plan string) string {
+	return osbServiceID + "-" + plan
+}
+
+// Outputs an error in the format expected by Open Service Broker platforms
+func outputOSBError(r render.Render, status int, description string) {
+	fmt.Println(description)
+	r.JSON(status, map[string]string{"description": description})
+}
+
+// Outputs the error for a request that can only be completed asynchronously, sent without
+// accepts_incomplete=true
+func outputOSBAsyncRequired(r render.Render) {
+	fmt.Println("Request requires accepts_incomplete=true")
+	r.JSON(422, map[string]string{"error": "AsyncRequired", "description": "This service plan requires client support for asynchronous service operations."})
+}
@@ -0,0 +1,116 @@
+package api
+
+import (
+	"fmt"
+
+	cloud "neptune-aws-api/cloud"
+	lifecycle "neptune-aws-api/lifecycle"
+	plans "neptune-aws-api/plans"
+	replicas "neptune-aws-api/replicas"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/neptune"
+	"github.com/go-martini/martini"
+	"github.com/martini-contrib/binding"
+	"github.com/martini-contrib/render"
+)
+
+type planchangespec struct {
+	Plan             string `json:"plan"`
+	ApplyImmediately *bool  `json:"apply_immediately"`
+}
+
+// Move a claimed instance to another plan by changing the instance class of its instance and of
+// its replicas, so that a failover promotes an instance of the same size. The change is applied
+// immediately unless apply_immediately is false, in which case AWS applies it in the next
+// maintenance window. The preprovisioner retries replicas that couldn't be changed yet and
+// updates the plan of the instance once all of them are done.
+func changePlan(spec planchangespec, berr binding.Errors, params martini.Params, r render.Render) {
+	name := params["name"]
+
+	if berr != nil || spec.Plan == "" {
+		fmt.Println("Invalid JSON")
+		r.Text(400, "Bad Request")
+		return
+	}
+
+	if !instanceExists(name) {
+		fmt.Println("Instance with specified name does not exist in provision table")
+		r.Text(400, "Bad Request")
+		return
+	}
+
+	plan, err := plans.Get(spec.Plan)
+	if err != nil {
+		r.JSON(400, map[string]string{"error": err.Error() + " " + spec.Plan})
+		return
+	}
+
+	state := queryDB("state", name)
+	if state != lifecycle.Claimed {
+		r.JSON(409, map[string]string{"error": "Instance is " + state + ", only claimed instances can change plan"})
+		return
+	}
+	current := queryDB("plan", name)
+	if current == plan.Name {
+		r.JSON(400, map[string]string{"error": "Instance is already on plan " + plan.Name})
+		return
+	}
+	// Serverless instances change their capacity range instead, their instance class is fixed
+	if currentPlan, err := plans.Get(current); plan.IsServerless() || (err == nil && currentPlan.IsServerless()) {
+		r.JSON(400, map[string]string{"error": "Serverless instances can't change plan, change their capacity instead"})
+		return
+	}
+
+	var pending int
+	err = pool.QueryRow("SELECT count(*) FROM plan_changes WHERE name=$1 AND status='pending'", name).Scan(&pending)
+	if err != nil {
+		output500Error(r, err)
+		return
+	}
+	if pending > 0 {
+		r.JSON(409, map[string]string{"error": "A plan change is already in progress"})
+		return
+	}
+
+	applyImmediately := spec.ApplyImmediately == nil || *spec.ApplyImmediately
+
+	svc := cloud.Neptune()
+	_, err = svc.ModifyDBInstance(&neptune.ModifyDBInstanceInput{
+		DBInstanceIdentifier: aws.String(name),
+		DBInstanceClass:      aws.String(plan.InstanceClass),
+		ApplyImmediately:     aws.Bool(applyImmediately),
+	})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == neptune.ErrCodeInvalidDBInstanceStateFault {
+		r.JSON(409, map[string]string{"error": aerr.Message()})
+		return
+	} else if err != nil {
+		output500Error(r, err)
+		return
+	}
+
+	_, err = pool.Exec("INSERT INTO plan_changes(name, oldplan, newplan, instanceclass, applyimmediately, status) VALUES ($1, $2, $3, $4, $5, 'pending')", name, current, plan.Name, plan.InstanceClass, applyImmediately)
+	if err != nil {
+		output500Error(r, err)
+		return
+	}
+
+	_, err = replicas.Resize(pool, name, plan.InstanceClass, applyImmediately)
+	if err != nil {
+		fmt.Println("Unable to change the instance class of the replicas of " + name + ", the preprovisioner will retry: " + err.Error())
+	}
+
+	fmt.Println("Changing plan of " + name + " from " + current + " to " + plan.Name)
+	r.JSON(202, map[string]interface{}{"Response": "Plan change in progress", "plan": plan.Name, "apply_immediately": applyImmediately})
+}
+
+// Returns the plan an instance is being moved to, if any
+func pendingPlan(name string) string {
+	var plan string
+	err := pool.QueryRow("SELECT newplan FROM plan_changes WHERE name=$1 AND status='pending' ORDER BY id DESC LIMIT 1", name).Scan(&plan)
+	if err != nil {
+		return ""
+	}
+	return plan
+}
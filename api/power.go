@@ -0,0 +1,165 @@
+package api
+
+import (
+	"fmt"
+
+	cloud "neptune-aws-api/cloud"
+	lifecycle "neptune-aws-api/lifecycle"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/neptune"
+	"github.com/go-martini/martini"
+	"github.com/martini-contrib/render"
+)
+
+// Reboot the instance of a claimed instance. Its endpoint is unavailable until it is back.
+func rebootInstance(params martini.Params, r render.Render) {
+	name := params["name"]
+
+	if !instanceExists(name) {
+		fmt.Println("Instance with specified name does not exist in provision table")
+		r.Text(400, "Bad Request")
+		return
+	}
+
+	state := queryDB("state", name)
+	if state != lifecycle.Claimed {
+		r.JSON(409, map[string]string{"error": "Instance is " + state + ", only claimed instances can be rebooted"})
+		return
+	}
+
+	_, err := cloud.Neptune().RebootDBInstance(&neptune.RebootDBInstanceInput{
+		DBInstanceIdentifier: aws.String(name),
+	})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == neptune.ErrCodeInvalidDBInstanceStateFault {
+		r.JSON(409, map[string]string{"error": aerr.Message()})
+		return
+	} else if err != nil {
+		output500Error(r, err)
+		return
+	}
+
+	fmt.Println("Rebooting " + name)
+	r.JSON(202, map[string]string{"Response": "Instance reboot in progress"})
+}
+
+// Stop the cluster of a claimed instance. Its access keys stay active, but /v1/neptune/url/:name
+// refuses to hand out the endpoint until it is started again. The instance is stopped before its
+// cluster, so that the endpoint is never handed out for a stopped cluster, and claimed again if
+// AWS refuses. AWS starts stopped clusters again after seven days, the preprovisioner stops them
+// again when it does.
+func stopInstance(params martini.Params, r render.Render) {
+	name := params["name"]
+
+	if !instanceExists(name) {
+		fmt.Println("Instance with specified name does not exist in provision table")
+		r.Text(400, "Bad Request")
+		return
+	}
+
+	state := queryDB("state", name)
+	if state != lifecycle.Claimed {
+		r.JSON(409, map[string]string{"error": "Instance is " + state + ", only claimed instances can be stopped"})
+		return
+	}
+
+	err := lifecycle.Transition(pool, name, lifecycle.Claimed, lifecycle.Stopped)
+	if err == lifecycle.ErrStateChanged {
+		r.JSON(409, map[string]string{"error": err.Error()})
+		return
+	} else if err != nil {
+		output500Error(r, err)
+		return
+	}
+
+	_, err = cloud.Neptune().StopDBCluster(&neptune.StopDBClusterInput{
+		DBClusterIdentifier: aws.String(name),
+	})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == neptune.ErrCodeInvalidDBClusterStateFault {
+		// The preprovisioner may have stopped the stopped instance's cluster already
+		status, serr := clusterStatus(name)
+		if serr != nil || (status != "stopping" && status != "stopped") {
+			undoStop(name)
+			r.JSON(409, map[string]string{"error": aerr.Message()})
+			return
+		}
+	} else if err != nil {
+		undoStop(name)
+		output500Error(r, err)
+		return
+	}
+
+	fmt.Println("Stopping cluster " + name)
+	r.JSON(202, map[string]string{"Response": "Instance stop in progress", "state": lifecycle.Stopped})
+}
+
+// Claim an instance again after AWS refused to stop its cluster. Should that fail as well, the
+// preprovisioner stops the cluster of the stopped instance, so the two never disagree for long.
+func undoStop(name string) {
+	err := lifecycle.Transition(pool, name, lifecycle.Stopped, lifecycle.Claimed)
+	if err != nil {
+		fmt.Println("Unable to claim " + name + " again after its cluster failed to stop: " + err.Error())
+	}
+}
+
+// Start the cluster of a stopped instance. It stays starting until the preprovisioner finds its
+// cluster available and makes it claimed again.
+func startInstance(params martini.Params, r render.Render) {
+	name := params["name"]
+
+	if !instanceExists(name) {
+		fmt.Println("Instance with specified name does not exist in provision table")
+		r.Text(400, "Bad Request")
+		return
+	}
+
+	state := queryDB("state", name)
+	if state != lifecycle.Stopped {
+		r.JSON(409, map[string]string{"error": "Instance is " + state + ", only stopped instances can be started"})
+		return
+	}
+
+	svc := cloud.Neptune()
+	_, err := svc.StartDBCluster(&neptune.StartDBClusterInput{
+		DBClusterIdentifier: aws.String(name),
+	})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == neptune.ErrCodeInvalidDBClusterStateFault {
+		// AWS may have started the cluster already, once it had been stopped for seven days
+		status, serr := clusterStatus(name)
+		if serr != nil {
+			output500Error(r, serr)
+			return
+		}
+		if status != "starting" && status != "available" {
+			r.JSON(409, map[string]string{"error": aerr.Message()})
+			return
+		}
+	} else if err != nil {
+		output500Error(r, err)
+		return
+	}
+
+	err = lifecycle.Transition(pool, name, lifecycle.Stopped, lifecycle.Starting)
+	if err == lifecycle.ErrStateChanged {
+		r.JSON(409, map[string]string{"error": err.Error()})
+		return
+	} else if err != nil {
+		output500Error(r, err)
+		return
+	}
+
+	fmt.Println("Starting cluster " + name)
+	r.JSON(202, map[string]string{"Response": "Instance start in progress", "state": lifecycle.Starting})
+}
+
+// Returns the AWS status of the cluster of an instance
+func clusterStatus(name string) (string, error) {
+	resp, err := cloud.Neptune().DescribeDBClusters(&neptune.DescribeDBClustersInput{
+		DBClusterIdentifier: aws.String(name),
+	})
+	if err != nil {
+		return "", err
+	}
+	return aws.StringValue(resp.DBClusters[0].Status), nil
+}
@@ -0,0 +1,173 @@
+package api
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"time"
+
+	lifecycle "neptune-aws-api/lifecycle"
+	plans "neptune-aws-api/plans"
+	replicas "neptune-aws-api/replicas"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/neptune"
+	"github.com/go-martini/martini"
+	"github.com/martini-contrib/render"
+)
+
+type replicaspec struct {
+	ID            string    `json:"id"`
+	Status        string    `json:"status"`
+	InstanceClass string    `json:"instance_class"`
+	Created       time.Time `json:"created"`
+}
+
+// Add a reader instance to the cluster of a claimed instance, using the instance class of its
+// plan. The preprovisioner follows it until it is available.
+func createReplica(params martini.Params, r render.Render) {
+	name := params["name"]
+
+	if !instanceExists(name) {
+		fmt.Println("Instance with specified name does not exist in provision table")
+		r.Text(400, "Bad Request")
+		return
+	}
+
+	state := queryDB("state", name)
+	if state != lifecycle.Claimed {
+		r.JSON(409, map[string]string{"error": "Instance is " + state + ", only claimed instances can have replicas"})
+		return
+	}
+
+	count, err := replicas.Active(pool, name)
+	if err != nil {
+		output500Error(r, err)
+		return
+	}
+	if count >= plans.MaxReplicas {
+		r.JSON(409, map[string]string{"error": "Instance already has " + strconv.Itoa(plans.MaxReplicas) + " replicas"})
+		return
+	}
+
+	plan, err := plans.Get(queryDB("plan", name))
+	if err != nil {
+		output500Error(r, err)
+		return
+	}
+
+	id, status, err := replicas.Create(pool, name, plan.InstanceClass, "")
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == neptune.ErrCodeInvalidDBClusterStateFault {
+		r.JSON(409, map[string]string{"error": aerr.Message()})
+		return
+	} else if err != nil {
+		output500Error(r, err)
+		return
+	}
+
+	r.JSON(202, replicaspec{ID: id, Status: status, InstanceClass: plan.InstanceClass, Created: time.Now().UTC()})
+}
+
+// Send the read replicas of an instance as a response, oldest first
+func listReplicas(params martini.Params, r render.Render) {
+	name := params["name"]
+
+	if !instanceExists(name) {
+		fmt.Println("Instance with specified name does not exist in provision table")
+		r.Text(400, "Bad Request")
+		return
+	}
+
+	list, err := getReplicas(name)
+	if err != nil {
+		output500Error(r, err)
+		return
+	}
+	r.JSON(200, list)
+}
+
+// Remove a read replica from the cluster of an instance. The preprovisioner marks it deleted
+// once it is gone.
+func deleteReplica(params martini.Params, r render.Render) {
+	name := params["name"]
+	id := params["id"]
+
+	var status string
+	err := pool.QueryRow("SELECT status FROM replicas WHERE id=$1 AND name=$2 AND status <> 'deleted'", id, name).Scan(&status)
+	if err == sql.ErrNoRows {
+		r.JSON(404, map[string]string{"error": "Replica does not exist"})
+		return
+	} else if err != nil {
+		output500Error(r, err)
+		return
+	}
+	if status == "deleting" {
+		r.JSON(409, map[string]string{"error": "Replica is already being deleted"})
+		return
+	}
+
+	writer, err := replicas.Writer(name)
+	if err != nil {
+		output500Error(r, err)
+		return
+	}
+	if writer == id {
+		r.JSON(409, map[string]string{"error": "Replica is the writer of the cluster, fail over to another instance first"})
+		return
+	}
+
+	plan, err := plans.Get(queryDB("plan", name))
+	if err != nil {
+		output500Error(r, err)
+		return
+	}
+	count, err := replicas.Active(pool, name)
+	if err != nil {
+		output500Error(r, err)
+		return
+	}
+	if plan.MultiAZ && count <= 1 {
+		r.JSON(409, map[string]string{"error": "Instance is on a multi-AZ plan and needs at least one replica to fail over to"})
+		return
+	}
+
+	_, err = replicas.Delete(pool, id)
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == neptune.ErrCodeInvalidDBInstanceStateFault {
+		r.JSON(409, map[string]string{"error": aerr.Message()})
+		return
+	} else if err != nil {
+		output500Error(r, err)
+		return
+	}
+
+	r.JSON(200, map[string]string{"Response": "Replica deletion in progress"})
+}
+
+// Returns the read replicas of an instance that haven't been deleted
+func getReplicas(name string) ([]replicaspec, error) {
+	rows, err := pool.Query("SELECT id, status, instanceclass, created FROM replicas WHERE name=$1 AND status <> 'deleted' ORDER BY created", name)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	replicas := []replicaspec{}
+	for rows.Next() {
+		var s replicaspec
+		err = rows.Scan(&s.ID, &s.Status, &s.InstanceClass, &s.Created)
+		if err != nil {
+			return nil, err
+		}
+		replicas = append(replicas, s)
+	}
+	return replicas, rows.Err()
+}
+
+// Returns the reader endpoint of a cluster, which balances connections across its replicas
+func readerEndpoint(cluster *neptune.DBCluster) string {
+	if cluster.ReaderEndpoint == nil {
+		return ""
+	}
+	return *cluster.ReaderEndpoint + ":" + strconv.FormatInt(aws.Int64Value(cluster.Port), 10)
+}
@@ -0,0 +1,153 @@
+package api
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	cloud "neptune-aws-api/cloud"
+	lifecycle "neptune-aws-api/lifecycle"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/neptune"
+	"github.com/go-martini/martini"
+	"github.com/martini-contrib/render"
+	uuid "github.com/nu7hatch/gouuid"
+)
+
+type snapshotspec struct {
+	ID          string    `json:"id"`
+	Status      string    `json:"status"`
+	Billingcode string    `json:"billingcode"`
+	Created     time.Time `json:"created"`
+}
+
+// Take a manual snapshot of the cluster of an instance. The preprovisioner follows it until it is available.
+func createSnapshot(params martini.Params, r render.Render) {
+	name := params["name"]
+
+	if !instanceExists(name) {
+		fmt.Println("Instance with specified name does not exist in provision table")
+		r.Text(400, "Bad Request")
+		return
+	}
+
+	state := queryDB("state", name)
+	if state != lifecycle.Available && state != lifecycle.Claimed {
+		r.JSON(409, map[string]string{"error": "Instance is " + state + ", only available and claimed instances can be snapshotted"})
+		return
+	}
+
+	snapshotuuid, _ := uuid.NewV4()
+	id := name + "-snapshot-" + strings.Split(snapshotuuid.String(), "-")[0]
+	billingcode := queryDB("billingcode", name)
+
+	svc := cloud.Neptune()
+	resp, err := svc.CreateDBClusterSnapshot(&neptune.CreateDBClusterSnapshotInput{
+		DBClusterIdentifier:         aws.String(name),
+		DBClusterSnapshotIdentifier: aws.String(id),
+		Tags: []*neptune.Tag{
+			{
+				Key:   aws.String("billingcode"),
+				Value: aws.String(billingcode),
+			},
+		},
+	})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == neptune.ErrCodeInvalidDBClusterStateFault {
+		r.JSON(409, map[string]string{"error": aerr.Message()})
+		return
+	} else if err != nil {
+		output500Error(r, err)
+		return
+	}
+
+	status := aws.StringValue(resp.DBClusterSnapshot.Status)
+	_, err = pool.Exec("INSERT INTO snapshots(id, name, billingcode, status) VALUES ($1, $2, $3, $4)", id, name, billingcode, status)
+	if err != nil {
+		output500Error(r, err)
+		return
+	}
+
+	r.JSON(202, snapshotspec{ID: id, Status: status, Billingcode: billingcode, Created: time.Now().UTC()})
+}
+
+// Send the snapshots of an instance as a response, newest first
+func listSnapshots(params martini.Params, r render.Render) {
+	name := params["name"]
+
+	if !instanceExists(name) {
+		fmt.Println("Instance with specified name does not exist in provision table")
+		r.Text(400, "Bad Request")
+		return
+	}
+
+	rows, err := pool.Query("SELECT id, status, coalesce(billingcode, ''), created FROM snapshots WHERE name=$1 AND status <> 'deleted' ORDER BY created DESC", name)
+	if err != nil {
+		output500Error(r, err)
+		return
+	}
+	defer rows.Close()
+
+	snapshots := []snapshotspec{}
+	for rows.Next() {
+		var s snapshotspec
+		err = rows.Scan(&s.ID, &s.Status, &s.Billingcode, &s.Created)
+		if err != nil {
+			output500Error(r, err)
+			return
+		}
+		snapshots = append(snapshots, s)
+	}
+	r.JSON(200, snapshots)
+}
+
+// Delete a snapshot of an instance. The preprovisioner marks it deleted once it is gone.
+func deleteSnapshot(params martini.Params, r render.Render) {
+	name := params["name"]
+	id := params["id"]
+
+	var status string
+	err := pool.QueryRow("SELECT status FROM snapshots WHERE id=$1 AND name=$2 AND status <> 'deleted'", id, name).Scan(&status)
+	if err == sql.ErrNoRows {
+		r.JSON(404, map[string]string{"error": "Snapshot does not exist"})
+		return
+	} else if err != nil {
+		output500Error(r, err)
+		return
+	}
+	if status == "deleting" {
+		r.JSON(409, map[string]string{"error": "Snapshot is already being deleted"})
+		return
+	}
+	if status == "pending" {
+		r.JSON(409, map[string]string{"error": "Snapshot has not been taken yet"})
+		return
+	}
+
+	svc := cloud.Neptune()
+	_, err = svc.DeleteDBClusterSnapshot(&neptune.DeleteDBClusterSnapshotInput{
+		DBClusterSnapshotIdentifier: aws.String(id),
+	})
+	aerr, _ := err.(awserr.Error)
+	if aerr != nil && aerr.Code() == neptune.ErrCodeDBClusterSnapshotNotFoundFault {
+		status = "deleted"
+	} else if aerr != nil && aerr.Code() == neptune.ErrCodeInvalidDBClusterSnapshotStateFault {
+		r.JSON(409, map[string]string{"error": aerr.Message()})
+		return
+	} else if err != nil {
+		output500Error(r, err)
+		return
+	} else {
+		status = "deleting"
+	}
+
+	_, err = pool.Exec("UPDATE snapshots SET status=$1 WHERE id=$2", status, id)
+	if err != nil {
+		output500Error(r, err)
+		return
+	}
+
+	r.JSON(200, map[string]string{"Response": "Snapshot deletion in progress"})
+}
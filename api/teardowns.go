@@ -0,0 +1,46 @@
+package api
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+
+	teardown "neptune-aws-api/teardown"
+
+	"github.com/go-martini/martini"
+	"github.com/martini-contrib/render"
+)
+
+// List the IAM teardown jobs that haven't finished, add ?stuck=true for only those that keep failing
+func listTeardowns(req *http.Request, r render.Render) {
+	jobs, err := teardown.Jobs(pool, req.URL.Query().Get("stuck") == "true")
+	if err != nil {
+		output500Error(r, err)
+		return
+	}
+	r.JSON(200, jobs)
+}
+
+// Attempt a pending IAM teardown job right away instead of waiting for its backoff
+func retryTeardown(params martini.Params, r render.Render) {
+	id, err := strconv.Atoi(params["id"])
+	if err != nil {
+		r.Text(400, "Bad Request")
+		return
+	}
+
+	done, err := teardown.Retry(pool, id)
+	if err == sql.ErrNoRows {
+		r.JSON(404, map[string]string{"error": "No pending teardown job with that id"})
+		return
+	} else if err != nil {
+		output500Error(r, err)
+		return
+	}
+	if !done {
+		r.JSON(409, map[string]string{"error": "Teardown failed again, see GET /v1/neptune/teardowns for the error"})
+		return
+	}
+
+	r.JSON(200, map[string]string{"Response": "Teardown finished"})
+}
@@ -0,0 +1,237 @@
+package autoscale
+
+import (
+	"database/sql"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	cloud "neptune-aws-api/cloud"
+	lifecycle "neptune-aws-api/lifecycle"
+	plans "neptune-aws-api/plans"
+	replicas "neptune-aws-api/replicas"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+)
+
+// Actions recorded in the autoscale_events table
+const (
+	Add    = "add"
+	Remove = "remove"
+	Hold   = "hold"
+)
+
+// Metrics are averaged over this window, in datapoints of a minute
+const window = 5 * time.Minute
+
+type decision struct {
+	name     string
+	metric   string
+	value    *float64
+	target   float64
+	replicas int
+	desired  int
+	action   string
+	reason   string
+	replica  string
+	err      error
+}
+
+// Run adds or removes a read replica of every claimed instance whose plan autoscales, when its
+// metric is away from the target. Decisions are recorded in the autoscale_events table.
+func Run(db *sql.DB) {
+	rows, err := db.Query("SELECT name, plan FROM provision WHERE state=$1 ORDER BY name", lifecycle.Claimed)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	claimed := make(map[string]string)
+	var names []string
+	for rows.Next() {
+		var name, plan string
+		err = rows.Scan(&name, &plan)
+		if err != nil {
+			fmt.Println(err)
+			rows.Close()
+			return
+		}
+		claimed[name] = plan
+		names = append(names, name)
+	}
+	rows.Close()
+
+	for _, name := range names {
+		plan, err := plans.Get(claimed[name])
+		if err != nil || plan.Autoscaling == nil {
+			continue
+		}
+		err = scale(db, name, plan)
+		if err != nil {
+			fmt.Println("Unable to autoscale " + name + ": " + err.Error())
+		}
+	}
+}
+
+func scale(db *sql.DB, name string, plan plans.Plan) error {
+	a := *plan.Autoscaling
+	// The reader of a multi-AZ plan is what it fails over to, so it is never scaled away
+	if plan.MultiAZ && a.MinReplicas < 1 {
+		a.MinReplicas = 1
+	}
+	if plan.MultiAZ && a.MaxReplicas < 1 {
+		a.MaxReplicas = 1
+	}
+
+	// Wait for replicas that are being created or deleted, their load isn't settled yet
+	var changing bool
+	err := db.QueryRow("SELECT EXISTS (SELECT FROM replicas WHERE name=$1 AND status IN ('creating', 'deleting'))", name).Scan(&changing)
+	if err != nil || changing {
+		return err
+	}
+
+	count, err := replicas.Active(db, name)
+	if err != nil {
+		return err
+	}
+	d := decision{name: name, metric: a.Metric, target: a.Target, replicas: count, desired: count, action: Hold}
+
+	value, ok, err := average(name, plans.Metrics[a.Metric])
+	if err != nil {
+		return err
+	}
+	if ok {
+		d.value = &value
+		d.desired = desired(count, value, a.Target)
+	}
+
+	switch {
+	case count < a.MinReplicas:
+		d.desired, d.reason = a.MinReplicas, "below min_replicas"
+	case count > a.MaxReplicas:
+		d.desired, d.reason = a.MaxReplicas, "above max_replicas"
+	case d.desired > a.MaxReplicas:
+		d.desired, d.reason = a.MaxReplicas, "above target at max_replicas"
+	case d.desired < a.MinReplicas:
+		d.desired, d.reason = a.MinReplicas, "below target at min_replicas"
+	case d.desired > count:
+		d.reason = "above target"
+	case d.desired < count:
+		d.reason = "below target"
+	}
+	if d.reason == "" {
+		// At the target, nothing to decide
+		return nil
+	}
+
+	if d.desired != count {
+		cooling, err := coolingDown(db, name, a.CooldownPeriod())
+		if err != nil {
+			return err
+		}
+		if cooling {
+			d.reason += ", cooling down"
+		} else if d.desired > count {
+			d.action = Add
+			d.replica, _, d.err = replicas.Create(db, name, plan.InstanceClass, "")
+		} else {
+			d.action = Remove
+			d.replica, d.err = newestReplica(db, name)
+			if d.err == nil {
+				_, d.err = replicas.Delete(db, d.replica)
+			}
+		}
+	}
+
+	return record(db, d)
+}
+
+// Returns how many replicas are needed for the metric to reach its target, assuming load is
+// spread evenly across the writer and the replicas. Moves by at most one replica at a time.
+func desired(count int, value float64, target float64) int {
+	needed := int(math.Ceil(float64(count+1)*value/target)) - 1
+	if needed > count {
+		return count + 1
+	} else if needed < count {
+		return count - 1
+	}
+	return count
+}
+
+// Returns the average of a Neptune metric of a cluster over the window, and false if there are
+// no datapoints
+func average(name string, metric string) (float64, bool, error) {
+	end := time.Now().UTC()
+	resp, err := cloud.CloudWatch().GetMetricStatistics(&cloudwatch.GetMetricStatisticsInput{
+		Namespace:  aws.String("AWS/Neptune"),
+		MetricName: aws.String(metric),
+		Dimensions: []*cloudwatch.Dimension{
+			{
+				Name:  aws.String("DBClusterIdentifier"),
+				Value: aws.String(name),
+			},
+		},
+		StartTime:  aws.Time(end.Add(-window)),
+		EndTime:    aws.Time(end),
+		Period:     aws.Int64(60),
+		Statistics: []*string{aws.String(cloudwatch.StatisticAverage)},
+	})
+	if err != nil {
+		return 0, false, err
+	}
+	if len(resp.Datapoints) == 0 {
+		return 0, false, nil
+	}
+
+	var sum float64
+	for _, datapoint := range resp.Datapoints {
+		sum += aws.Float64Value(datapoint.Average)
+	}
+	return sum / float64(len(resp.Datapoints)), true, nil
+}
+
+// Returns whether a replica of an instance was added or removed within the cooldown period
+func coolingDown(db *sql.DB, name string, cooldown time.Duration) (bool, error) {
+	var cooling bool
+	err := db.QueryRow("SELECT EXISTS (SELECT FROM autoscale_events WHERE name=$1 AND action IN ($2, $3) AND error IS NULL AND created > now() - $4 * interval '1 second')", name, Add, Remove, int64(cooldown.Seconds())).Scan(&cooling)
+	return cooling, err
+}
+
+// Returns the most recently created replica of an instance that is available, skipping the
+// one that is the writer after a failover
+func newestReplica(db *sql.DB, name string) (string, error) {
+	writer, err := replicas.Writer(name)
+	if err != nil {
+		return "", err
+	}
+	var id string
+	err = db.QueryRow("SELECT id FROM replicas WHERE name=$1 AND status='available' AND id <> $2 ORDER BY created DESC LIMIT 1", name, writer).Scan(&id)
+	return id, err
+}
+
+// Record a decision. A hold is only recorded when it differs from the previous decision about
+// the instance, so that an instance held at its bounds doesn't add a row every run.
+func record(db *sql.DB, d decision) error {
+	if d.action == Hold {
+		var action, reason string
+		err := db.QueryRow("SELECT action, coalesce(reason, '') FROM autoscale_events WHERE name=$1 ORDER BY id DESC LIMIT 1", d.name).Scan(&action, &reason)
+		if err == nil && action == d.action && reason == d.reason {
+			return nil
+		} else if err != nil && err != sql.ErrNoRows {
+			return err
+		}
+	}
+
+	var errtext *string
+	message := d.name + ": " + d.action + " (" + d.reason + "), " + strconv.Itoa(d.replicas) + " replicas, " + strconv.Itoa(d.desired) + " desired"
+	if d.err != nil {
+		errtext = aws.String(d.err.Error())
+		message += ", failed: " + d.err.Error()
+	}
+	fmt.Println("Autoscaling " + message)
+
+	_, err := db.Exec("INSERT INTO autoscale_events(name, metric, value, target, replicas, desired, action, reason, replica, error) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, NULLIF($9, ''), $10)",
+		d.name, d.metric, d.value, d.target, d.replicas, d.desired, d.action, d.reason, d.replica, errtext)
+	return err
+}
@@ -0,0 +1,292 @@
+package autoscale
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"testing"
+
+	cloud "neptune-aws-api/cloud"
+	plans "neptune-aws-api/plans"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/neptune"
+)
+
+func TestDesired(t *testing.T) {
+	tests := []struct {
+		count  int
+		value  float64
+		target float64
+		want   int
+	}{
+		{0, 50, 50, 0},
+		{0, 51, 50, 1},
+		{0, 500, 50, 1},
+		{2, 50, 50, 2},
+		{2, 10, 50, 1},
+		{2, 0, 50, 1},
+		{0, 10, 50, 0},
+		{3, 75, 50, 4},
+	}
+	for _, tt := range tests {
+		if got := desired(tt.count, tt.value, tt.target); got != tt.want {
+			t.Errorf("desired(%d, %v, %v) = %d, expected %d", tt.count, tt.value, tt.target, got, tt.want)
+		}
+	}
+}
+
+// fakeDB answers the queries scale makes from its fields and records what it writes
+type fakeDB struct {
+	changing   bool
+	active     int
+	cooling    bool
+	lastAction string
+	lastReason string
+	newest     string
+	events     [][]driver.Value
+	writes     []string
+}
+
+var fakeDBs = make(map[string]*fakeDB)
+
+func init() {
+	sql.Register("autoscaletest", fakeDriver{})
+}
+
+type fakeDriver struct{}
+
+func (fakeDriver) Open(name string) (driver.Conn, error) {
+	return fakeConn{fakeDBs[name]}, nil
+}
+
+type fakeConn struct{ db *fakeDB }
+
+func (c fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return fakeStmt{c.db, query}, nil
+}
+func (c fakeConn) Close() error { return nil }
+func (c fakeConn) Begin() (driver.Tx, error) {
+	return nil, errors.New("transactions are not supported")
+}
+
+type fakeStmt struct {
+	db    *fakeDB
+	query string
+}
+
+func (s fakeStmt) Close() error  { return nil }
+func (s fakeStmt) NumInput() int { return -1 }
+
+func (s fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	if strings.HasPrefix(s.query, "INSERT INTO autoscale_events") {
+		s.db.events = append(s.db.events, args)
+	} else {
+		s.db.writes = append(s.db.writes, s.query)
+	}
+	return driver.RowsAffected(1), nil
+}
+
+func (s fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	switch {
+	case strings.Contains(s.query, "status IN ('creating', 'deleting')"):
+		return &fakeRows{values: [][]driver.Value{{s.db.changing}}}, nil
+	case strings.HasPrefix(s.query, "SELECT count(*) FROM replicas"):
+		return &fakeRows{values: [][]driver.Value{{int64(s.db.active)}}}, nil
+	case strings.Contains(s.query, "FROM autoscale_events WHERE name=$1 AND action IN"):
+		return &fakeRows{values: [][]driver.Value{{s.db.cooling}}}, nil
+	case strings.HasPrefix(s.query, "SELECT action"):
+		if s.db.lastAction == "" {
+			return &fakeRows{}, nil
+		}
+		return &fakeRows{values: [][]driver.Value{{s.db.lastAction, s.db.lastReason}}}, nil
+	case strings.HasPrefix(s.query, "SELECT coalesce(billingcode"):
+		return &fakeRows{values: [][]driver.Value{{"test"}}}, nil
+	case strings.HasPrefix(s.query, "SELECT id FROM replicas"):
+		return &fakeRows{values: [][]driver.Value{{s.db.newest}}}, nil
+	}
+	return nil, errors.New("unexpected query: " + s.query)
+}
+
+type fakeRows struct {
+	values [][]driver.Value
+}
+
+func (r *fakeRows) Columns() []string {
+	if len(r.values) == 0 {
+		return []string{""}
+	}
+	return make([]string, len(r.values[0]))
+}
+func (r *fakeRows) Close() error { return nil }
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.values) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.values[0])
+	r.values = r.values[1:]
+	return nil
+}
+
+// Creates a cluster with a writer in the fake cloud and a fake database for it
+func setup(t *testing.T, name string, f *fakeDB) *sql.DB {
+	svc := cloud.Neptune()
+	_, err := svc.CreateDBCluster(&neptune.CreateDBClusterInput{DBClusterIdentifier: aws.String(name)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = svc.CreateDBInstance(&neptune.CreateDBInstanceInput{DBClusterIdentifier: aws.String(name), DBInstanceIdentifier: aws.String(name)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fakeDBs[name] = f
+	db, err := sql.Open("autoscaletest", name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestScale(t *testing.T) {
+	os.Setenv("FAKE_CLOUD_DELAY", "0s")
+	err := cloud.Init("fake")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plan := plans.Plan{
+		InstanceClass: "db.r5.large",
+		Autoscaling: &plans.Autoscaling{
+			MinReplicas: 1,
+			MaxReplicas: 3,
+			Metric:      "cpu",
+			Target:      50,
+			Cooldown:    "5m",
+		},
+	}
+
+	tests := []struct {
+		name    string
+		db      fakeDB
+		value   *float64
+		action  string
+		reason  string
+		desired int64
+		writes  int
+	}{
+		{name: "below-min", db: fakeDB{active: 0}, action: Add, reason: "below min_replicas", desired: 1, writes: 1},
+		{name: "above-max", db: fakeDB{active: 4, newest: "above-max-replica"}, action: Remove, reason: "above max_replicas", desired: 3, writes: 1},
+		{name: "clamped-max", db: fakeDB{active: 3}, value: aws.Float64(90), action: Hold, reason: "above target at max_replicas", desired: 3},
+		{name: "clamped-min", db: fakeDB{active: 1}, value: aws.Float64(5), action: Hold, reason: "below target at min_replicas", desired: 1},
+		{name: "scale-up", db: fakeDB{active: 1}, value: aws.Float64(80), action: Add, reason: "above target", desired: 2, writes: 1},
+		{name: "scale-down", db: fakeDB{active: 3, newest: "scale-down-replica"}, value: aws.Float64(10), action: Remove, reason: "below target", desired: 2, writes: 1},
+		{name: "cooling", db: fakeDB{active: 1, cooling: true}, value: aws.Float64(80), action: Hold, reason: "above target, cooling down", desired: 2},
+		{name: "repeated-hold", db: fakeDB{active: 3, lastAction: Hold, lastReason: "above target at max_replicas"}, value: aws.Float64(90)},
+		{name: "at-target", db: fakeDB{active: 1}, value: aws.Float64(50)},
+		{name: "no-datapoints", db: fakeDB{active: 2}},
+		{name: "changing", db: fakeDB{changing: true, active: 0}},
+	}
+	for _, tt := range tests {
+		f := tt.db
+		db := setup(t, tt.name, &f)
+		if tt.value != nil {
+			cloud.CloudWatch().(*cloud.FakeCloudWatch).SetMetric(tt.name, "CPUUtilization", *tt.value)
+		}
+
+		err := scale(db, tt.name, plan)
+		if err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+			continue
+		}
+		if len(f.writes) != tt.writes {
+			t.Errorf("%s: %d replica writes, expected %d: %v", tt.name, len(f.writes), tt.writes, f.writes)
+		}
+		if tt.action == "" {
+			if len(f.events) != 0 {
+				t.Errorf("%s: recorded %v, expected no event", tt.name, f.events)
+			}
+			continue
+		}
+		if len(f.events) != 1 {
+			t.Errorf("%s: recorded %d events, expected 1", tt.name, len(f.events))
+			continue
+		}
+
+		// name, metric, value, target, replicas, desired, action, reason, replica, error
+		event := f.events[0]
+		if event[0] != tt.name || event[1] != "cpu" || event[3] != float64(50) || event[4] != int64(f.active) {
+			t.Errorf("%s: recorded %v", tt.name, event)
+		}
+		if event[5] != tt.desired || event[6] != tt.action || event[7] != tt.reason {
+			t.Errorf("%s: recorded %v %v (%v), expected %v %v (%v)", tt.name, event[6], event[5], event[7], tt.action, tt.desired, tt.reason)
+		}
+		if tt.value == nil && event[2] != nil {
+			t.Errorf("%s: recorded value %v without datapoints", tt.name, event[2])
+		}
+		if event[9] != nil {
+			t.Errorf("%s: recorded error %v", tt.name, event[9])
+		}
+		replica, _ := event[8].(string)
+		if tt.action == Hold && replica != "" {
+			t.Errorf("%s: recorded replica %s for a hold", tt.name, replica)
+		} else if tt.action == Add && !strings.HasPrefix(replica, tt.name+"-replica-") {
+			t.Errorf("%s: recorded replica %q for an add", tt.name, replica)
+		} else if tt.action == Remove && replica != f.newest {
+			t.Errorf("%s: recorded replica %q, expected %s", tt.name, replica, f.newest)
+		}
+	}
+}
+
+func TestScaleMultiAZ(t *testing.T) {
+	os.Setenv("FAKE_CLOUD_DELAY", "0s")
+	err := cloud.Init("fake")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The reader of a multi-AZ plan is kept even when autoscaling allows none
+	tests := []struct {
+		name   string
+		max    int
+		value  *float64
+		reason string
+	}{
+		{name: "multi-az-low", max: 2, value: aws.Float64(1), reason: "below target at min_replicas"},
+		{name: "multi-az-max-0", max: 0},
+		{name: "multi-az-max-0-low", max: 0, value: aws.Float64(1), reason: "below target at min_replicas"},
+		{name: "multi-az-max-0-high", max: 0, value: aws.Float64(90), reason: "above target at max_replicas"},
+	}
+	for _, tt := range tests {
+		plan := plans.Plan{
+			InstanceClass: "db.r5.large",
+			MultiAZ:       true,
+			Autoscaling:   &plans.Autoscaling{MinReplicas: 0, MaxReplicas: tt.max, Metric: "cpu", Target: 50},
+		}
+		f := fakeDB{active: 1}
+		db := setup(t, tt.name, &f)
+		if tt.value != nil {
+			cloud.CloudWatch().(*cloud.FakeCloudWatch).SetMetric(tt.name, "CPUUtilization", *tt.value)
+		}
+
+		err = scale(db, tt.name, plan)
+		if err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+			continue
+		}
+		if len(f.writes) != 0 {
+			t.Errorf("%s: changed the replicas of a multi-AZ instance: %v", tt.name, f.writes)
+		}
+		if tt.reason == "" {
+			if len(f.events) != 0 {
+				t.Errorf("%s: recorded %v, expected no event", tt.name, f.events)
+			}
+		} else if len(f.events) != 1 || f.events[0][6] != Hold || f.events[0][7] != tt.reason {
+			t.Errorf("%s: recorded %v, expected a hold (%s)", tt.name, f.events, tt.reason)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package cloud
+
+import (
+	"errors"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/aws/aws-sdk-go/service/iam"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/aws/aws-sdk-go/service/neptune"
+)
+
+// NeptuneAPI is the subset of the Neptune API used by the broker. It is satisfied by *neptune.Neptune.
+type NeptuneAPI interface {
+	CreateDBCluster(*neptune.CreateDBClusterInput) (*neptune.CreateDBClusterOutput, error)
+	DescribeDBClusters(*neptune.DescribeDBClustersInput) (*neptune.DescribeDBClustersOutput, error)
+	DeleteDBCluster(*neptune.DeleteDBClusterInput) (*neptune.DeleteDBClusterOutput, error)
+	CreateDBInstance(*neptune.CreateDBInstanceInput) (*neptune.CreateDBInstanceOutput, error)
+	DescribeDBInstances(*neptune.DescribeDBInstancesInput) (*neptune.DescribeDBInstancesOutput, error)
+	DeleteDBInstance(*neptune.DeleteDBInstanceInput) (*neptune.DeleteDBInstanceOutput, error)
+	ModifyDBInstance(*neptune.ModifyDBInstanceInput) (*neptune.ModifyDBInstanceOutput, error)
+	AddTagsToResource(*neptune.AddTagsToResourceInput) (*neptune.AddTagsToResourceOutput, error)
+	ListTagsForResource(*neptune.ListTagsForResourceInput) (*neptune.ListTagsForResourceOutput, error)
+	CreateDBClusterSnapshot(*neptune.CreateDBClusterSnapshotInput) (*neptune.CreateDBClusterSnapshotOutput, error)
+	DescribeDBClusterSnapshots(*neptune.DescribeDBClusterSnapshotsInput) (*neptune.DescribeDBClusterSnapshotsOutput, error)
+	DeleteDBClusterSnapshot(*neptune.DeleteDBClusterSnapshotInput) (*neptune.DeleteDBClusterSnapshotOutput, error)
+	RestoreDBClusterFromSnapshot(*neptune.RestoreDBClusterFromSnapshotInput) (*neptune.RestoreDBClusterFromSnapshotOutput, error)
+	RestoreDBClusterToPointInTime(*neptune.RestoreDBClusterToPointInTimeInput) (*neptune.RestoreDBClusterToPointInTimeOutput, error)
+	ModifyDBCluster(*neptune.ModifyDBClusterInput) (*neptune.ModifyDBClusterOutput, error)
+	StopDBCluster(*neptune.StopDBClusterInput) (*neptune.StopDBClusterOutput, error)
+	StartDBCluster(*neptune.StartDBClusterInput) (*neptune.StartDBClusterOutput, error)
+	FailoverDBCluster(*neptune.FailoverDBClusterInput) (*neptune.FailoverDBClusterOutput, error)
+	RebootDBInstance(*neptune.RebootDBInstanceInput) (*neptune.RebootDBInstanceOutput, error)
+	DescribeDBSubnetGroups(*neptune.DescribeDBSubnetGroupsInput) (*neptune.DescribeDBSubnetGroupsOutput, error)
+}
+
+// IAMAPI is the subset of the IAM API used by the broker. It is satisfied by *iam.IAM.
+type IAMAPI interface {
+	CreateUser(*iam.CreateUserInput) (*iam.CreateUserOutput, error)
+	DeleteUser(*iam.DeleteUserInput) (*iam.DeleteUserOutput, error)
+	ListUsers(*iam.ListUsersInput) (*iam.ListUsersOutput, error)
+	CreateAccessKey(*iam.CreateAccessKeyInput) (*iam.CreateAccessKeyOutput, error)
+	DeleteAccessKey(*iam.DeleteAccessKeyInput) (*iam.DeleteAccessKeyOutput, error)
+	ListAccessKeys(*iam.ListAccessKeysInput) (*iam.ListAccessKeysOutput, error)
+	UpdateAccessKey(*iam.UpdateAccessKeyInput) (*iam.UpdateAccessKeyOutput, error)
+	CreatePolicy(*iam.CreatePolicyInput) (*iam.CreatePolicyOutput, error)
+	DeletePolicy(*iam.DeletePolicyInput) (*iam.DeletePolicyOutput, error)
+	ListPolicies(*iam.ListPoliciesInput) (*iam.ListPoliciesOutput, error)
+	AttachUserPolicy(*iam.AttachUserPolicyInput) (*iam.AttachUserPolicyOutput, error)
+	DetachUserPolicy(*iam.DetachUserPolicyInput) (*iam.DetachUserPolicyOutput, error)
+	ListAttachedUserPolicies(*iam.ListAttachedUserPoliciesInput) (*iam.ListAttachedUserPoliciesOutput, error)
+}
+
+// KMSAPI is the subset of the KMS API used by the broker. It is satisfied by *kms.KMS.
+type KMSAPI interface {
+	GenerateDataKey(*kms.GenerateDataKeyInput) (*kms.GenerateDataKeyOutput, error)
+	Decrypt(*kms.DecryptInput) (*kms.DecryptOutput, error)
+}
+
+// CloudWatchAPI is the subset of the CloudWatch API used by the broker. It is satisfied by
+// *cloudwatch.CloudWatch.
+type CloudWatchAPI interface {
+	GetMetricStatistics(*cloudwatch.GetMetricStatisticsInput) (*cloudwatch.GetMetricStatisticsOutput, error)
+}
+
+var _ NeptuneAPI = (*FakeNeptune)(nil)
+var _ IAMAPI = (*FakeIAM)(nil)
+var _ KMSAPI = (*FakeKMS)(nil)
+var _ CloudWatchAPI = (*FakeCloudWatch)(nil)
+
+var neptunesvc NeptuneAPI
+var iamsvc IAMAPI
+var kmssvc KMSAPI
+var cloudwatchsvc CloudWatchAPI
+
+// Init selects the cloud provider used by Neptune(), IAM(), KMS() and CloudWatch(). Supported providers are
+// "aws" (the default) and "fake", an in-memory backend for running without AWS.
+func Init(provider string) error {
+	switch provider {
+	case "", "aws":
+		sess := session.New(&aws.Config{
+			Region: aws.String(os.Getenv("REGION")),
+		})
+		neptunesvc = neptune.New(sess)
+		iamsvc = iam.New(sess)
+		kmssvc = kms.New(sess)
+		cloudwatchsvc = cloudwatch.New(sess)
+	case "fake":
+		delay := 30 * time.Second
+		if os.Getenv("FAKE_CLOUD_DELAY") != "" {
+			d, err := time.ParseDuration(os.Getenv("FAKE_CLOUD_DELAY"))
+			if err != nil {
+				return errors.New("Invalid FAKE_CLOUD_DELAY: " + err.Error())
+			}
+			delay = d
+		}
+		fake := NewFakeNeptune(delay)
+		if os.Getenv("FAKE_AUTO_START") != "" {
+			d, err := time.ParseDuration(os.Getenv("FAKE_AUTO_START"))
+			if err != nil {
+				return errors.New("Invalid FAKE_AUTO_START: " + err.Error())
+			}
+			fake.autoStart = d
+		}
+		neptunesvc = fake
+		iamsvc = NewFakeIAM()
+		kmssvc = NewFakeKMS()
+		cloudwatchsvc = NewFakeCloudWatch()
+	default:
+		return errors.New("Unknown cloud provider " + provider + ", expected aws or fake")
+	}
+	return nil
+}
+
+// Neptune returns the Neptune client of the selected provider
+func Neptune() NeptuneAPI {
+	return neptunesvc
+}
+
+// IAM returns the IAM client of the selected provider
+func IAM() IAMAPI {
+	return iamsvc
+}
+
+// KMS returns the KMS client of the selected provider
+func KMS() KMSAPI {
+	return kmssvc
+}
+
+// CloudWatch returns the CloudWatch client of the selected provider
+func CloudWatch() CloudWatchAPI {
+	return cloudwatchsvc
+}
@@ -0,0 +1,71 @@
+package cloud
+
+import (
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+)
+
+// FakeCloudWatch is an in-memory CloudWatch backend that reports fixed metric values. Values
+// are set per metric and cluster with SetMetric, and FAKE_METRIC_VALUE is reported for every
+// other metric when set. Metrics without a value have no datapoints.
+type FakeCloudWatch struct {
+	sync.Mutex
+	values map[string]float64
+}
+
+// NewFakeCloudWatch returns a fake CloudWatch backend
+func NewFakeCloudWatch() *FakeCloudWatch {
+	return &FakeCloudWatch{values: make(map[string]float64)}
+}
+
+// SetMetric sets the value reported for a metric of a cluster
+func (f *FakeCloudWatch) SetMetric(cluster string, metric string, value float64) {
+	f.Lock()
+	defer f.Unlock()
+	f.values[cluster+"/"+metric] = value
+}
+
+// GetMetricStatistics simulates cloudwatch.GetMetricStatistics, returning one datapoint per
+// period with every statistic set to the value of the metric
+func (f *FakeCloudWatch) GetMetricStatistics(input *cloudwatch.GetMetricStatisticsInput) (*cloudwatch.GetMetricStatisticsOutput, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	var cluster string
+	for _, d := range input.Dimensions {
+		if aws.StringValue(d.Name) == "DBClusterIdentifier" {
+			cluster = aws.StringValue(d.Value)
+		}
+	}
+
+	output := &cloudwatch.GetMetricStatisticsOutput{Label: input.MetricName}
+	value, ok := f.values[cluster+"/"+aws.StringValue(input.MetricName)]
+	if !ok {
+		fallback, err := strconv.ParseFloat(os.Getenv("FAKE_METRIC_VALUE"), 64)
+		if err != nil {
+			return output, nil
+		}
+		value = fallback
+	}
+
+	period := time.Duration(aws.Int64Value(input.Period)) * time.Second
+	if period <= 0 {
+		period = time.Minute
+	}
+	for t := aws.TimeValue(input.StartTime); t.Before(aws.TimeValue(input.EndTime)); t = t.Add(period) {
+		output.Datapoints = append(output.Datapoints, &cloudwatch.Datapoint{
+			Average:     aws.Float64(value),
+			Maximum:     aws.Float64(value),
+			Minimum:     aws.Float64(value),
+			SampleCount: aws.Float64(1),
+			Sum:         aws.Float64(value),
+			Timestamp:   aws.Time(t),
+		})
+	}
+	return output, nil
+}
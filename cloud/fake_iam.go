@@ -0,0 +1,320 @@
+package cloud
+
+import (
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/iam"
+)
+
+type fakeUser struct {
+	user     iam.User
+	keys     []*iam.AccessKeyMetadata
+	attached []string
+}
+
+// FakeIAM is an in-memory IAM backend. Like IAM it refuses to delete users that still
+// have access keys or attached policies, and policies that are still attached.
+type FakeIAM struct {
+	sync.Mutex
+	users    map[string]*fakeUser
+	policies map[string]*iam.Policy
+}
+
+// NewFakeIAM returns an empty in-memory IAM backend
+func NewFakeIAM() *FakeIAM {
+	return &FakeIAM{
+		users:    make(map[string]*fakeUser),
+		policies: make(map[string]*iam.Policy),
+	}
+}
+
+func noSuchEntity(message string) error {
+	return awserr.New(iam.ErrCodeNoSuchEntityException, message, nil)
+}
+
+func (f *FakeIAM) user(name *string) (*fakeUser, error) {
+	u, ok := f.users[aws.StringValue(name)]
+	if !ok {
+		return nil, noSuchEntity("The user with name " + aws.StringValue(name) + " cannot be found.")
+	}
+	return u, nil
+}
+
+// CreateUser simulates iam.CreateUser
+func (f *FakeIAM) CreateUser(input *iam.CreateUserInput) (*iam.CreateUserOutput, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	name := aws.StringValue(input.UserName)
+	if _, ok := f.users[name]; ok {
+		return nil, awserr.New(iam.ErrCodeEntityAlreadyExistsException, "User with name "+name+" already exists.", nil)
+	}
+
+	u := &fakeUser{user: iam.User{
+		Arn:        aws.String("arn:aws:iam::" + os.Getenv("ACCOUNTNUMBER") + ":user/" + name),
+		CreateDate: aws.Time(time.Now().UTC()),
+		Path:       aws.String("/"),
+		UserId:     aws.String(fakeID("AIDA")),
+		UserName:   aws.String(name),
+	}}
+	f.users[name] = u
+
+	user := u.user
+	return &iam.CreateUserOutput{User: &user}, nil
+}
+
+// DeleteUser simulates iam.DeleteUser
+func (f *FakeIAM) DeleteUser(input *iam.DeleteUserInput) (*iam.DeleteUserOutput, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	u, err := f.user(input.UserName)
+	if err != nil {
+		return nil, err
+	}
+	if len(u.keys) > 0 || len(u.attached) > 0 {
+		return nil, awserr.New(iam.ErrCodeDeleteConflictException, "Cannot delete entity, must delete access keys and detach policies first.", nil)
+	}
+
+	delete(f.users, *input.UserName)
+	return &iam.DeleteUserOutput{}, nil
+}
+
+// ListUsers simulates iam.ListUsers, returning every user in a single page
+func (f *FakeIAM) ListUsers(input *iam.ListUsersInput) (*iam.ListUsersOutput, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	var names []string
+	for name := range f.users {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	output := &iam.ListUsersOutput{IsTruncated: aws.Bool(false)}
+	for _, name := range names {
+		user := f.users[name].user
+		output.Users = append(output.Users, &user)
+	}
+	return output, nil
+}
+
+// CreateAccessKey simulates iam.CreateAccessKey
+func (f *FakeIAM) CreateAccessKey(input *iam.CreateAccessKeyInput) (*iam.CreateAccessKeyOutput, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	u, err := f.user(input.UserName)
+	if err != nil {
+		return nil, err
+	}
+	if len(u.keys) >= 2 {
+		return nil, awserr.New(iam.ErrCodeLimitExceededException, "Cannot exceed quota for AccessKeysPerUser: 2", nil)
+	}
+
+	key := &iam.AccessKey{
+		AccessKeyId:     aws.String(fakeID("AKIA")[:20]),
+		CreateDate:      aws.Time(time.Now().UTC()),
+		SecretAccessKey: aws.String(fakeID("") + fakeID("")[:14]),
+		Status:          aws.String(iam.StatusTypeActive),
+		UserName:        input.UserName,
+	}
+	u.keys = append(u.keys, &iam.AccessKeyMetadata{
+		AccessKeyId: key.AccessKeyId,
+		CreateDate:  key.CreateDate,
+		Status:      key.Status,
+		UserName:    key.UserName,
+	})
+
+	return &iam.CreateAccessKeyOutput{AccessKey: key}, nil
+}
+
+// DeleteAccessKey simulates iam.DeleteAccessKey
+func (f *FakeIAM) DeleteAccessKey(input *iam.DeleteAccessKeyInput) (*iam.DeleteAccessKeyOutput, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	u, err := f.user(input.UserName)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, key := range u.keys {
+		if *key.AccessKeyId == aws.StringValue(input.AccessKeyId) {
+			u.keys = append(u.keys[:i], u.keys[i+1:]...)
+			return &iam.DeleteAccessKeyOutput{}, nil
+		}
+	}
+	return nil, noSuchEntity("The Access Key with id " + aws.StringValue(input.AccessKeyId) + " cannot be found.")
+}
+
+// ListAccessKeys simulates iam.ListAccessKeys
+func (f *FakeIAM) ListAccessKeys(input *iam.ListAccessKeysInput) (*iam.ListAccessKeysOutput, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	u, err := f.user(input.UserName)
+	if err != nil {
+		return nil, err
+	}
+
+	output := &iam.ListAccessKeysOutput{IsTruncated: aws.Bool(false)}
+	for _, key := range u.keys {
+		k := *key
+		output.AccessKeyMetadata = append(output.AccessKeyMetadata, &k)
+	}
+	return output, nil
+}
+
+// UpdateAccessKey simulates iam.UpdateAccessKey
+func (f *FakeIAM) UpdateAccessKey(input *iam.UpdateAccessKeyInput) (*iam.UpdateAccessKeyOutput, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	u, err := f.user(input.UserName)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, key := range u.keys {
+		if aws.StringValue(key.AccessKeyId) == aws.StringValue(input.AccessKeyId) {
+			key.Status = aws.String(aws.StringValue(input.Status))
+			return &iam.UpdateAccessKeyOutput{}, nil
+		}
+	}
+	return nil, noSuchEntity("The Access Key with id " + aws.StringValue(input.AccessKeyId) + " cannot be found.")
+}
+
+// CreatePolicy simulates iam.CreatePolicy
+func (f *FakeIAM) CreatePolicy(input *iam.CreatePolicyInput) (*iam.CreatePolicyOutput, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	arn := "arn:aws:iam::" + os.Getenv("ACCOUNTNUMBER") + ":policy/" + aws.StringValue(input.PolicyName)
+	if _, ok := f.policies[arn]; ok {
+		return nil, awserr.New(iam.ErrCodeEntityAlreadyExistsException, "A policy called "+aws.StringValue(input.PolicyName)+" already exists.", nil)
+	}
+
+	policy := &iam.Policy{
+		Arn:             aws.String(arn),
+		AttachmentCount: aws.Int64(0),
+		CreateDate:      aws.Time(time.Now().UTC()),
+		Path:            aws.String("/"),
+		PolicyId:        aws.String(fakeID("ANPA")),
+		PolicyName:      input.PolicyName,
+	}
+	f.policies[arn] = policy
+
+	p := *policy
+	return &iam.CreatePolicyOutput{Policy: &p}, nil
+}
+
+// DeletePolicy simulates iam.DeletePolicy
+func (f *FakeIAM) DeletePolicy(input *iam.DeletePolicyInput) (*iam.DeletePolicyOutput, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	policy, ok := f.policies[aws.StringValue(input.PolicyArn)]
+	if !ok {
+		return nil, noSuchEntity("Policy " + aws.StringValue(input.PolicyArn) + " was not found.")
+	}
+	if *policy.AttachmentCount > 0 {
+		return nil, awserr.New(iam.ErrCodeDeleteConflictException, "Cannot delete a policy attached to entities.", nil)
+	}
+
+	delete(f.policies, *input.PolicyArn)
+	return &iam.DeletePolicyOutput{}, nil
+}
+
+// ListPolicies simulates iam.ListPolicies, returning every policy in a single page
+func (f *FakeIAM) ListPolicies(input *iam.ListPoliciesInput) (*iam.ListPoliciesOutput, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	var arns []string
+	for arn := range f.policies {
+		arns = append(arns, arn)
+	}
+	sort.Strings(arns)
+
+	output := &iam.ListPoliciesOutput{IsTruncated: aws.Bool(false)}
+	for _, arn := range arns {
+		policy := *f.policies[arn]
+		output.Policies = append(output.Policies, &policy)
+	}
+	return output, nil
+}
+
+// AttachUserPolicy simulates iam.AttachUserPolicy
+func (f *FakeIAM) AttachUserPolicy(input *iam.AttachUserPolicyInput) (*iam.AttachUserPolicyOutput, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	u, err := f.user(input.UserName)
+	if err != nil {
+		return nil, err
+	}
+	policy, ok := f.policies[aws.StringValue(input.PolicyArn)]
+	if !ok {
+		return nil, noSuchEntity("Policy " + aws.StringValue(input.PolicyArn) + " does not exist or is not attachable.")
+	}
+
+	for _, arn := range u.attached {
+		if arn == *policy.Arn {
+			return &iam.AttachUserPolicyOutput{}, nil
+		}
+	}
+	u.attached = append(u.attached, *policy.Arn)
+	policy.AttachmentCount = aws.Int64(*policy.AttachmentCount + 1)
+
+	return &iam.AttachUserPolicyOutput{}, nil
+}
+
+// DetachUserPolicy simulates iam.DetachUserPolicy
+func (f *FakeIAM) DetachUserPolicy(input *iam.DetachUserPolicyInput) (*iam.DetachUserPolicyOutput, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	u, err := f.user(input.UserName)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, arn := range u.attached {
+		if arn == aws.StringValue(input.PolicyArn) {
+			u.attached = append(u.attached[:i], u.attached[i+1:]...)
+			if policy, ok := f.policies[arn]; ok {
+				policy.AttachmentCount = aws.Int64(*policy.AttachmentCount - 1)
+			}
+			return &iam.DetachUserPolicyOutput{}, nil
+		}
+	}
+	return nil, noSuchEntity("Policy " + aws.StringValue(input.PolicyArn) + " was not found.")
+}
+
+// ListAttachedUserPolicies simulates iam.ListAttachedUserPolicies
+func (f *FakeIAM) ListAttachedUserPolicies(input *iam.ListAttachedUserPoliciesInput) (*iam.ListAttachedUserPoliciesOutput, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	u, err := f.user(input.UserName)
+	if err != nil {
+		return nil, err
+	}
+
+	output := &iam.ListAttachedUserPoliciesOutput{IsTruncated: aws.Bool(false)}
+	attached := append([]string{}, u.attached...)
+	sort.Strings(attached)
+	for _, arn := range attached {
+		output.AttachedPolicies = append(output.AttachedPolicies, &iam.AttachedPolicy{
+			PolicyArn:  aws.String(arn),
+			PolicyName: f.policies[arn].PolicyName,
+		})
+	}
+	return output, nil
+}
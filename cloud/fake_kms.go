@@ -0,0 +1,62 @@
+package cloud
+
+import (
+	"bytes"
+	"crypto/rand"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/kms"
+)
+
+var fakeKMSPrefix = []byte("fakekms:")
+
+// FakeKMS is a stand-in for KMS. Data keys are "wrapped" by prefixing them with the key ID,
+// so they survive restarts but are not protected at all. Use a local key file instead when
+// the stored secrets matter.
+type FakeKMS struct{}
+
+// NewFakeKMS returns a fake KMS backend
+func NewFakeKMS() *FakeKMS {
+	return &FakeKMS{}
+}
+
+// GenerateDataKey simulates kms.GenerateDataKey
+func (f *FakeKMS) GenerateDataKey(input *kms.GenerateDataKeyInput) (*kms.GenerateDataKeyOutput, error) {
+	keyid := aws.StringValue(input.KeyId)
+	if keyid == "" {
+		return nil, awserr.New(kms.ErrCodeNotFoundException, "Key ID is required", nil)
+	}
+
+	plaintext := make([]byte, 32)
+	_, err := rand.Read(plaintext)
+	if err != nil {
+		return nil, err
+	}
+
+	blob := append(append(append([]byte{}, fakeKMSPrefix...), keyid...), 0)
+	blob = append(blob, plaintext...)
+	return &kms.GenerateDataKeyOutput{
+		CiphertextBlob: blob,
+		KeyId:          aws.String(keyid),
+		Plaintext:      plaintext,
+	}, nil
+}
+
+// Decrypt simulates kms.Decrypt
+func (f *FakeKMS) Decrypt(input *kms.DecryptInput) (*kms.DecryptOutput, error) {
+	blob := input.CiphertextBlob
+	if !bytes.HasPrefix(blob, fakeKMSPrefix) {
+		return nil, awserr.New(kms.ErrCodeInvalidCiphertextException, "Ciphertext was not produced by the fake KMS", nil)
+	}
+	blob = blob[len(fakeKMSPrefix):]
+
+	end := bytes.IndexByte(blob, 0)
+	if end < 0 {
+		return nil, awserr.New(kms.ErrCodeInvalidCiphertextException, "Ciphertext is truncated", nil)
+	}
+	return &kms.DecryptOutput{
+		KeyId:     aws.String(string(blob[:end])),
+		Plaintext: append([]byte{}, blob[end+1:]...),
+	}, nil
+}
@@ -0,0 +1,827 @@
+package cloud
+
+import (
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	uuid "github.com/nu7hatch/gouuid"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/neptune"
+)
+
+const fakeDeleted = "deleted"
+
+// fakeStatus is a simulated resource status that moves to next once delay has passed
+type fakeStatus struct {
+	status string
+	next   string
+	until  time.Time
+}
+
+func (s *fakeStatus) set(status string, next string, delay time.Duration) {
+	s.status = status
+	s.next = next
+	s.until = time.Now().Add(delay)
+}
+
+// settle applies a pending transition and reports whether the resource still exists
+func (s *fakeStatus) settle() bool {
+	if s.next != "" && !time.Now().Before(s.until) {
+		s.status = s.next
+		s.next = ""
+	}
+	return s.status != fakeDeleted
+}
+
+type fakeCluster struct {
+	fakeStatus
+	cluster neptune.DBCluster
+}
+
+type fakeInstance struct {
+	fakeStatus
+	instance neptune.DBInstance
+	// An instance class change that takes effect at applyAt
+	pendingClass string
+	applyAt      time.Time
+}
+
+type fakeSnapshot struct {
+	fakeStatus
+	snapshot neptune.DBClusterSnapshot
+}
+
+// FakeNeptune is an in-memory Neptune backend. Created clusters and instances report
+// "creating" until delay has passed and then become "available", deleted ones report
+// "deleting" for the same delay before they disappear. Cluster snapshots behave the same way.
+// Like in AWS, a cluster that has been stopped for autoStart is started again.
+type FakeNeptune struct {
+	sync.Mutex
+	delay     time.Duration
+	autoStart time.Duration
+	clusters  map[string]*fakeCluster
+	instances map[string]*fakeInstance
+	snapshots map[string]*fakeSnapshot
+	tags      map[string][]*neptune.Tag
+}
+
+// NewFakeNeptune returns an empty in-memory Neptune backend
+func NewFakeNeptune(delay time.Duration) *FakeNeptune {
+	return &FakeNeptune{
+		delay:     delay,
+		autoStart: 7 * 24 * time.Hour,
+		clusters:  make(map[string]*fakeCluster),
+		instances: make(map[string]*fakeInstance),
+		snapshots: make(map[string]*fakeSnapshot),
+		tags:      make(map[string][]*neptune.Tag),
+	}
+}
+
+func fakeARN(kind string, name string) string {
+	return "arn:aws:rds:" + os.Getenv("REGION") + ":" + os.Getenv("ACCOUNTNUMBER") + ":" + kind + ":" + name
+}
+
+func fakeID(prefix string) string {
+	id, _ := uuid.NewV4()
+	return prefix + strings.ToUpper(strings.Replace(id.String(), "-", "", -1)[:26])
+}
+
+// settle applies pending transitions to every resource, removing deleted ones
+func (f *FakeNeptune) settle() {
+	for name, c := range f.clusters {
+		if !c.settle() {
+			delete(f.clusters, name)
+			delete(f.tags, *c.cluster.DBClusterArn)
+			continue
+		}
+		// c.until is when the cluster finished stopping
+		if c.status == "stopped" && !time.Now().Before(c.until.Add(f.autoStart)) {
+			c.set("starting", "available", f.delay)
+			for _, m := range c.cluster.DBClusterMembers {
+				if i, ok := f.instances[*m.DBInstanceIdentifier]; ok {
+					i.set("starting", "available", f.delay)
+				}
+			}
+		}
+	}
+	for name, i := range f.instances {
+		if i.pendingClass != "" && !time.Now().Before(i.applyAt) {
+			i.instance.DBInstanceClass = aws.String(i.pendingClass)
+			i.pendingClass = ""
+		}
+		if !i.settle() {
+			delete(f.instances, name)
+			delete(f.tags, *i.instance.DBInstanceArn)
+			if c, ok := f.clusters[aws.StringValue(i.instance.DBClusterIdentifier)]; ok {
+				var members []*neptune.DBClusterMember
+				for _, m := range c.cluster.DBClusterMembers {
+					if *m.DBInstanceIdentifier != name {
+						members = append(members, m)
+					}
+				}
+				c.cluster.DBClusterMembers = members
+			}
+		}
+	}
+	for name, s := range f.snapshots {
+		if !s.settle() {
+			delete(f.snapshots, name)
+			delete(f.tags, *s.snapshot.DBClusterSnapshotArn)
+		}
+	}
+}
+
+func (f *FakeNeptune) describeCluster(c *fakeCluster) *neptune.DBCluster {
+	cluster := c.cluster
+	cluster.Status = aws.String(c.status)
+	// A cluster is multi-AZ once its instances are spread over more than one availability zone
+	zones := make(map[string]bool)
+	for _, m := range cluster.DBClusterMembers {
+		if i, ok := f.instances[*m.DBInstanceIdentifier]; ok {
+			zones[aws.StringValue(i.instance.AvailabilityZone)] = true
+		}
+	}
+	cluster.MultiAZ = aws.Bool(len(zones) > 1)
+	if c.status != "creating" {
+		cluster.EarliestRestorableTime = cluster.ClusterCreateTime
+		cluster.LatestRestorableTime = aws.Time(time.Now().UTC())
+	}
+	return &cluster
+}
+
+func (f *FakeNeptune) describeSnapshot(s *fakeSnapshot) *neptune.DBClusterSnapshot {
+	snapshot := s.snapshot
+	snapshot.Status = aws.String(s.status)
+	snapshot.PercentProgress = aws.Int64(0)
+	if s.status != "creating" {
+		snapshot.PercentProgress = aws.Int64(100)
+	}
+	return &snapshot
+}
+
+func (f *FakeNeptune) describeInstance(i *fakeInstance) *neptune.DBInstance {
+	instance := i.instance
+	instance.DBInstanceStatus = aws.String(i.status)
+	if i.status == "creating" {
+		instance.Endpoint = nil
+	}
+	if i.pendingClass != "" {
+		instance.PendingModifiedValues = &neptune.PendingModifiedValues{DBInstanceClass: aws.String(i.pendingClass)}
+	}
+	return &instance
+}
+
+// CreateDBCluster simulates neptune.CreateDBCluster
+func (f *FakeNeptune) CreateDBCluster(input *neptune.CreateDBClusterInput) (*neptune.CreateDBClusterOutput, error) {
+	f.Lock()
+	defer f.Unlock()
+	f.settle()
+
+	name := aws.StringValue(input.DBClusterIdentifier)
+	if _, ok := f.clusters[name]; ok {
+		return nil, awserr.New(neptune.ErrCodeDBClusterAlreadyExistsFault, "DB Cluster already exists", nil)
+	}
+
+	c := f.addCluster(neptune.DBCluster{
+		DBClusterIdentifier:              aws.String(name),
+		DBClusterParameterGroup:          input.DBClusterParameterGroupName,
+		DBSubnetGroup:                    input.DBSubnetGroupName,
+		DeletionProtection:               aws.Bool(aws.BoolValue(input.DeletionProtection)),
+		Engine:                           input.Engine,
+		EngineVersion:                    input.EngineVersion,
+		IAMDatabaseAuthenticationEnabled: aws.Bool(aws.BoolValue(input.EnableIAMDatabaseAuthentication)),
+		KmsKeyId:                         input.KmsKeyId,
+		ServerlessV2ScalingConfiguration: fakeScaling(input.ServerlessV2ScalingConfiguration),
+		StorageEncrypted:                 aws.Bool(aws.BoolValue(input.StorageEncrypted)),
+	}, input.Tags)
+
+	return &neptune.CreateDBClusterOutput{DBCluster: f.describeCluster(c)}, nil
+}
+
+// fakeScaling copies a serverless scaling configuration as it is described
+func fakeScaling(config *neptune.ServerlessV2ScalingConfiguration) *neptune.ServerlessV2ScalingConfigurationInfo {
+	if config == nil {
+		return nil
+	}
+	return &neptune.ServerlessV2ScalingConfigurationInfo{
+		MinCapacity: aws.Float64(aws.Float64Value(config.MinCapacity)),
+		MaxCapacity: aws.Float64(aws.Float64Value(config.MaxCapacity)),
+	}
+}
+
+// addCluster fills in the generated attributes of a new cluster and starts creating it
+func (f *FakeNeptune) addCluster(cluster neptune.DBCluster, tags []*neptune.Tag) *fakeCluster {
+	name := aws.StringValue(cluster.DBClusterIdentifier)
+	if aws.StringValue(cluster.EngineVersion) == "" {
+		cluster.EngineVersion = aws.String("1.2.0.0")
+	}
+	host := name + ".cluster-fake." + os.Getenv("REGION") + ".neptune.amazonaws.com"
+
+	cluster.ClusterCreateTime = aws.Time(time.Now().UTC())
+	cluster.DBClusterArn = aws.String(fakeARN("cluster", name))
+	cluster.DbClusterResourceId = aws.String(fakeID("cluster-"))
+	cluster.Endpoint = aws.String(host)
+	cluster.ReaderEndpoint = aws.String(strings.Replace(host, ".cluster-", ".cluster-ro-", 1))
+	cluster.Port = aws.Int64(8182)
+
+	c := &fakeCluster{cluster: cluster}
+	c.set("creating", "available", f.delay)
+	f.clusters[name] = c
+	f.tags[*c.cluster.DBClusterArn] = tags
+	return c
+}
+
+// DescribeDBClusters simulates neptune.DescribeDBClusters
+func (f *FakeNeptune) DescribeDBClusters(input *neptune.DescribeDBClustersInput) (*neptune.DescribeDBClustersOutput, error) {
+	f.Lock()
+	defer f.Unlock()
+	f.settle()
+
+	output := &neptune.DescribeDBClustersOutput{}
+	if input.DBClusterIdentifier != nil {
+		c, ok := f.clusters[*input.DBClusterIdentifier]
+		if !ok {
+			return nil, awserr.New(neptune.ErrCodeDBClusterNotFoundFault, "DBCluster "+*input.DBClusterIdentifier+" not found", nil)
+		}
+		output.DBClusters = append(output.DBClusters, f.describeCluster(c))
+		return output, nil
+	}
+
+	var names []string
+	for name := range f.clusters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		output.DBClusters = append(output.DBClusters, f.describeCluster(f.clusters[name]))
+	}
+	return output, nil
+}
+
+// DeleteDBCluster simulates neptune.DeleteDBCluster
+func (f *FakeNeptune) DeleteDBCluster(input *neptune.DeleteDBClusterInput) (*neptune.DeleteDBClusterOutput, error) {
+	f.Lock()
+	defer f.Unlock()
+	f.settle()
+
+	c, ok := f.clusters[aws.StringValue(input.DBClusterIdentifier)]
+	if !ok {
+		return nil, awserr.New(neptune.ErrCodeDBClusterNotFoundFault, "DBCluster "+aws.StringValue(input.DBClusterIdentifier)+" not found", nil)
+	}
+	if c.status == "deleting" {
+		return nil, awserr.New(neptune.ErrCodeInvalidDBClusterStateFault, "DBCluster is already being deleted", nil)
+	}
+	if aws.BoolValue(c.cluster.DeletionProtection) {
+		return nil, awserr.New("InvalidParameterCombination", "Cannot delete protected Cluster, please disable deletion protection and try again.", nil)
+	}
+
+	if !aws.BoolValue(input.SkipFinalSnapshot) {
+		snapshot := aws.StringValue(input.FinalDBSnapshotIdentifier)
+		if snapshot == "" {
+			return nil, awserr.New("InvalidParameterCombination", "FinalDBSnapshotIdentifier is required unless SkipFinalSnapshot is set", nil)
+		}
+		if _, ok := f.snapshots[snapshot]; ok {
+			return nil, awserr.New(neptune.ErrCodeDBClusterSnapshotAlreadyExistsFault, "DB Cluster Snapshot already exists", nil)
+		}
+		f.addSnapshot(c, snapshot, f.tags[*c.cluster.DBClusterArn])
+	}
+
+	c.set("deleting", fakeDeleted, f.delay)
+	return &neptune.DeleteDBClusterOutput{DBCluster: f.describeCluster(c)}, nil
+}
+
+// ModifyDBCluster simulates neptune.ModifyDBCluster. Changes are applied immediately.
+func (f *FakeNeptune) ModifyDBCluster(input *neptune.ModifyDBClusterInput) (*neptune.ModifyDBClusterOutput, error) {
+	f.Lock()
+	defer f.Unlock()
+	f.settle()
+
+	c, ok := f.clusters[aws.StringValue(input.DBClusterIdentifier)]
+	if !ok {
+		return nil, awserr.New(neptune.ErrCodeDBClusterNotFoundFault, "DBCluster "+aws.StringValue(input.DBClusterIdentifier)+" not found", nil)
+	}
+	if c.status != "available" {
+		return nil, awserr.New(neptune.ErrCodeInvalidDBClusterStateFault, "DBCluster is not in the available state", nil)
+	}
+
+	if input.DeletionProtection != nil {
+		c.cluster.DeletionProtection = aws.Bool(*input.DeletionProtection)
+	}
+	if input.EngineVersion != nil {
+		c.cluster.EngineVersion = aws.String(*input.EngineVersion)
+	}
+	if input.ServerlessV2ScalingConfiguration != nil {
+		c.cluster.ServerlessV2ScalingConfiguration = fakeScaling(input.ServerlessV2ScalingConfiguration)
+	}
+
+	return &neptune.ModifyDBClusterOutput{DBCluster: f.describeCluster(c)}, nil
+}
+
+// CreateDBInstance simulates neptune.CreateDBInstance
+func (f *FakeNeptune) CreateDBInstance(input *neptune.CreateDBInstanceInput) (*neptune.CreateDBInstanceOutput, error) {
+	f.Lock()
+	defer f.Unlock()
+	f.settle()
+
+	name := aws.StringValue(input.DBInstanceIdentifier)
+	if _, ok := f.instances[name]; ok {
+		return nil, awserr.New(neptune.ErrCodeDBInstanceAlreadyExistsFault, "DB Instance already exists", nil)
+	}
+	c, ok := f.clusters[aws.StringValue(input.DBClusterIdentifier)]
+	if !ok {
+		return nil, awserr.New(neptune.ErrCodeDBClusterNotFoundFault, "DBCluster "+aws.StringValue(input.DBClusterIdentifier)+" not found", nil)
+	}
+	if aws.StringValue(input.DBInstanceClass) == "db.serverless" && c.cluster.ServerlessV2ScalingConfiguration == nil {
+		return nil, awserr.New("InvalidParameterCombination", "db.serverless instances require a cluster with a serverless scaling configuration", nil)
+	}
+
+	zone := aws.StringValue(input.AvailabilityZone)
+	if zone == "" {
+		zone = os.Getenv("REGION") + "a"
+	}
+	tier := int64(1)
+	if input.PromotionTier != nil {
+		tier = *input.PromotionTier
+	}
+
+	i := &fakeInstance{instance: neptune.DBInstance{
+		AvailabilityZone:                 aws.String(zone),
+		DBClusterIdentifier:              c.cluster.DBClusterIdentifier,
+		DBInstanceArn:                    aws.String(fakeARN("db", name)),
+		DBInstanceClass:                  input.DBInstanceClass,
+		DBInstanceIdentifier:             aws.String(name),
+		DbiResourceId:                    aws.String(fakeID("db-")),
+		Endpoint:                         &neptune.Endpoint{Address: aws.String(name + ".fake." + os.Getenv("REGION") + ".neptune.amazonaws.com"), Port: aws.Int64(8182)},
+		Engine:                           input.Engine,
+		EngineVersion:                    c.cluster.EngineVersion,
+		IAMDatabaseAuthenticationEnabled: c.cluster.IAMDatabaseAuthenticationEnabled,
+		InstanceCreateTime:               aws.Time(time.Now().UTC()),
+		KmsKeyId:                         c.cluster.KmsKeyId,
+		MultiAZ:                          aws.Bool(false),
+		PromotionTier:                    aws.Int64(tier),
+		StorageEncrypted:                 c.cluster.StorageEncrypted,
+	}}
+	i.set("creating", "available", f.delay)
+	f.instances[name] = i
+	f.tags[*i.instance.DBInstanceArn] = input.Tags
+
+	c.cluster.DBClusterMembers = append(c.cluster.DBClusterMembers, &neptune.DBClusterMember{
+		DBInstanceIdentifier: aws.String(name),
+		IsClusterWriter:      aws.Bool(len(c.cluster.DBClusterMembers) == 0),
+		PromotionTier:        aws.Int64(tier),
+	})
+
+	return &neptune.CreateDBInstanceOutput{DBInstance: f.describeInstance(i)}, nil
+}
+
+// DescribeDBInstances simulates neptune.DescribeDBInstances
+func (f *FakeNeptune) DescribeDBInstances(input *neptune.DescribeDBInstancesInput) (*neptune.DescribeDBInstancesOutput, error) {
+	f.Lock()
+	defer f.Unlock()
+	f.settle()
+
+	output := &neptune.DescribeDBInstancesOutput{}
+	if input.DBInstanceIdentifier != nil {
+		i, ok := f.instances[*input.DBInstanceIdentifier]
+		if !ok {
+			return nil, awserr.New(neptune.ErrCodeDBInstanceNotFoundFault, "DBInstance "+*input.DBInstanceIdentifier+" not found", nil)
+		}
+		output.DBInstances = append(output.DBInstances, f.describeInstance(i))
+		return output, nil
+	}
+
+	var names []string
+	for name := range f.instances {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		output.DBInstances = append(output.DBInstances, f.describeInstance(f.instances[name]))
+	}
+	return output, nil
+}
+
+// DeleteDBInstance simulates neptune.DeleteDBInstance
+func (f *FakeNeptune) DeleteDBInstance(input *neptune.DeleteDBInstanceInput) (*neptune.DeleteDBInstanceOutput, error) {
+	f.Lock()
+	defer f.Unlock()
+	f.settle()
+
+	i, ok := f.instances[aws.StringValue(input.DBInstanceIdentifier)]
+	if !ok {
+		return nil, awserr.New(neptune.ErrCodeDBInstanceNotFoundFault, "DBInstance "+aws.StringValue(input.DBInstanceIdentifier)+" not found", nil)
+	}
+	if i.status == "deleting" {
+		return nil, awserr.New(neptune.ErrCodeInvalidDBInstanceStateFault, "DBInstance is already being deleted", nil)
+	}
+
+	i.set("deleting", fakeDeleted, f.delay)
+	return &neptune.DeleteDBInstanceOutput{DBInstance: f.describeInstance(i)}, nil
+}
+
+// ModifyDBInstance simulates neptune.ModifyDBInstance. A new instance class is applied after
+// delay when applied immediately, and after twice the delay otherwise, as if the maintenance
+// window had come.
+func (f *FakeNeptune) ModifyDBInstance(input *neptune.ModifyDBInstanceInput) (*neptune.ModifyDBInstanceOutput, error) {
+	f.Lock()
+	defer f.Unlock()
+	f.settle()
+
+	i, ok := f.instances[aws.StringValue(input.DBInstanceIdentifier)]
+	if !ok {
+		return nil, awserr.New(neptune.ErrCodeDBInstanceNotFoundFault, "DBInstance "+aws.StringValue(input.DBInstanceIdentifier)+" not found", nil)
+	}
+	if i.status != "available" {
+		return nil, awserr.New(neptune.ErrCodeInvalidDBInstanceStateFault, "DBInstance is not in the available state", nil)
+	}
+
+	if input.DeletionProtection != nil {
+		i.instance.DeletionProtection = aws.Bool(*input.DeletionProtection)
+	}
+	if input.PromotionTier != nil {
+		i.instance.PromotionTier = aws.Int64(*input.PromotionTier)
+		if c, ok := f.clusters[aws.StringValue(i.instance.DBClusterIdentifier)]; ok {
+			for _, m := range c.cluster.DBClusterMembers {
+				if *m.DBInstanceIdentifier == *i.instance.DBInstanceIdentifier {
+					m.PromotionTier = aws.Int64(*input.PromotionTier)
+				}
+			}
+		}
+	}
+	if class := aws.StringValue(input.DBInstanceClass); class != "" && class != aws.StringValue(i.instance.DBInstanceClass) {
+		i.pendingClass = class
+		if aws.BoolValue(input.ApplyImmediately) {
+			i.applyAt = time.Now().Add(f.delay)
+			i.set("modifying", "available", f.delay)
+		} else {
+			i.applyAt = time.Now().Add(2 * f.delay)
+		}
+	}
+
+	return &neptune.ModifyDBInstanceOutput{DBInstance: f.describeInstance(i)}, nil
+}
+
+// AddTagsToResource simulates neptune.AddTagsToResource
+func (f *FakeNeptune) AddTagsToResource(input *neptune.AddTagsToResourceInput) (*neptune.AddTagsToResourceOutput, error) {
+	f.Lock()
+	defer f.Unlock()
+	f.settle()
+
+	arn := aws.StringValue(input.ResourceName)
+	existing, ok := f.tags[arn]
+	if !ok && !f.exists(arn) {
+		return nil, awserr.New(neptune.ErrCodeDBInstanceNotFoundFault, "Resource "+arn+" not found", nil)
+	}
+
+	for _, tag := range input.Tags {
+		replaced := false
+		for _, e := range existing {
+			if aws.StringValue(e.Key) == aws.StringValue(tag.Key) {
+				e.Value = tag.Value
+				replaced = true
+			}
+		}
+		if !replaced {
+			existing = append(existing, &neptune.Tag{Key: tag.Key, Value: tag.Value})
+		}
+	}
+	f.tags[arn] = existing
+
+	return &neptune.AddTagsToResourceOutput{}, nil
+}
+
+// ListTagsForResource simulates neptune.ListTagsForResource
+func (f *FakeNeptune) ListTagsForResource(input *neptune.ListTagsForResourceInput) (*neptune.ListTagsForResourceOutput, error) {
+	f.Lock()
+	defer f.Unlock()
+	f.settle()
+
+	arn := aws.StringValue(input.ResourceName)
+	tags, ok := f.tags[arn]
+	if !ok && !f.exists(arn) {
+		return nil, awserr.New(neptune.ErrCodeDBInstanceNotFoundFault, "Resource "+arn+" not found", nil)
+	}
+
+	output := &neptune.ListTagsForResourceOutput{TagList: []*neptune.Tag{}}
+	for _, tag := range tags {
+		output.TagList = append(output.TagList, &neptune.Tag{Key: tag.Key, Value: tag.Value})
+	}
+	return output, nil
+}
+
+// CreateDBClusterSnapshot simulates neptune.CreateDBClusterSnapshot
+func (f *FakeNeptune) CreateDBClusterSnapshot(input *neptune.CreateDBClusterSnapshotInput) (*neptune.CreateDBClusterSnapshotOutput, error) {
+	f.Lock()
+	defer f.Unlock()
+	f.settle()
+
+	name := aws.StringValue(input.DBClusterSnapshotIdentifier)
+	if _, ok := f.snapshots[name]; ok {
+		return nil, awserr.New(neptune.ErrCodeDBClusterSnapshotAlreadyExistsFault, "DB Cluster Snapshot already exists", nil)
+	}
+	c, ok := f.clusters[aws.StringValue(input.DBClusterIdentifier)]
+	if !ok {
+		return nil, awserr.New(neptune.ErrCodeDBClusterNotFoundFault, "DBCluster "+aws.StringValue(input.DBClusterIdentifier)+" not found", nil)
+	}
+	if c.status != "available" {
+		return nil, awserr.New(neptune.ErrCodeInvalidDBClusterStateFault, "DBCluster is not in the available state", nil)
+	}
+
+	s := f.addSnapshot(c, name, input.Tags)
+	return &neptune.CreateDBClusterSnapshotOutput{DBClusterSnapshot: f.describeSnapshot(s)}, nil
+}
+
+// addSnapshot starts creating a manual snapshot of a cluster
+func (f *FakeNeptune) addSnapshot(c *fakeCluster, name string, tags []*neptune.Tag) *fakeSnapshot {
+	s := &fakeSnapshot{snapshot: neptune.DBClusterSnapshot{
+		ClusterCreateTime:           c.cluster.ClusterCreateTime,
+		DBClusterIdentifier:         c.cluster.DBClusterIdentifier,
+		DBClusterSnapshotArn:        aws.String(fakeARN("cluster-snapshot", name)),
+		DBClusterSnapshotIdentifier: aws.String(name),
+		Engine:                      c.cluster.Engine,
+		EngineVersion:               c.cluster.EngineVersion,
+		KmsKeyId:                    c.cluster.KmsKeyId,
+		SnapshotCreateTime:          aws.Time(time.Now().UTC()),
+		SnapshotType:                aws.String("manual"),
+		StorageEncrypted:            c.cluster.StorageEncrypted,
+	}}
+	s.set("creating", "available", f.delay)
+	f.snapshots[name] = s
+	f.tags[*s.snapshot.DBClusterSnapshotArn] = tags
+	return s
+}
+
+// DescribeDBClusterSnapshots simulates neptune.DescribeDBClusterSnapshots
+func (f *FakeNeptune) DescribeDBClusterSnapshots(input *neptune.DescribeDBClusterSnapshotsInput) (*neptune.DescribeDBClusterSnapshotsOutput, error) {
+	f.Lock()
+	defer f.Unlock()
+	f.settle()
+
+	output := &neptune.DescribeDBClusterSnapshotsOutput{}
+	if input.DBClusterSnapshotIdentifier != nil {
+		s, ok := f.snapshots[*input.DBClusterSnapshotIdentifier]
+		if !ok {
+			return nil, awserr.New(neptune.ErrCodeDBClusterSnapshotNotFoundFault, "DBClusterSnapshot "+*input.DBClusterSnapshotIdentifier+" not found", nil)
+		}
+		output.DBClusterSnapshots = append(output.DBClusterSnapshots, f.describeSnapshot(s))
+		return output, nil
+	}
+
+	var names []string
+	for name, s := range f.snapshots {
+		if input.DBClusterIdentifier == nil || *input.DBClusterIdentifier == *s.snapshot.DBClusterIdentifier {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		output.DBClusterSnapshots = append(output.DBClusterSnapshots, f.describeSnapshot(f.snapshots[name]))
+	}
+	return output, nil
+}
+
+// DeleteDBClusterSnapshot simulates neptune.DeleteDBClusterSnapshot
+func (f *FakeNeptune) DeleteDBClusterSnapshot(input *neptune.DeleteDBClusterSnapshotInput) (*neptune.DeleteDBClusterSnapshotOutput, error) {
+	f.Lock()
+	defer f.Unlock()
+	f.settle()
+
+	s, ok := f.snapshots[aws.StringValue(input.DBClusterSnapshotIdentifier)]
+	if !ok {
+		return nil, awserr.New(neptune.ErrCodeDBClusterSnapshotNotFoundFault, "DBClusterSnapshot "+aws.StringValue(input.DBClusterSnapshotIdentifier)+" not found", nil)
+	}
+	if s.status != "available" {
+		return nil, awserr.New(neptune.ErrCodeInvalidDBClusterSnapshotStateFault, "DBClusterSnapshot is not in the available state", nil)
+	}
+
+	s.set("deleting", fakeDeleted, f.delay)
+	return &neptune.DeleteDBClusterSnapshotOutput{DBClusterSnapshot: f.describeSnapshot(s)}, nil
+}
+
+// RestoreDBClusterFromSnapshot simulates neptune.RestoreDBClusterFromSnapshot
+func (f *FakeNeptune) RestoreDBClusterFromSnapshot(input *neptune.RestoreDBClusterFromSnapshotInput) (*neptune.RestoreDBClusterFromSnapshotOutput, error) {
+	f.Lock()
+	defer f.Unlock()
+	f.settle()
+
+	name := aws.StringValue(input.DBClusterIdentifier)
+	if _, ok := f.clusters[name]; ok {
+		return nil, awserr.New(neptune.ErrCodeDBClusterAlreadyExistsFault, "DB Cluster already exists", nil)
+	}
+	s, ok := f.snapshots[aws.StringValue(input.SnapshotIdentifier)]
+	if !ok {
+		return nil, awserr.New(neptune.ErrCodeDBClusterSnapshotNotFoundFault, "DBClusterSnapshot "+aws.StringValue(input.SnapshotIdentifier)+" not found", nil)
+	}
+	if s.status != "available" {
+		return nil, awserr.New(neptune.ErrCodeInvalidDBClusterSnapshotStateFault, "DBClusterSnapshot is not in the available state", nil)
+	}
+
+	engineVersion := input.EngineVersion
+	if engineVersion == nil {
+		engineVersion = s.snapshot.EngineVersion
+	}
+	c := f.addCluster(neptune.DBCluster{
+		DBClusterIdentifier:              aws.String(name),
+		DBClusterParameterGroup:          input.DBClusterParameterGroupName,
+		DBSubnetGroup:                    input.DBSubnetGroupName,
+		DeletionProtection:               aws.Bool(aws.BoolValue(input.DeletionProtection)),
+		Engine:                           input.Engine,
+		EngineVersion:                    engineVersion,
+		IAMDatabaseAuthenticationEnabled: aws.Bool(aws.BoolValue(input.EnableIAMDatabaseAuthentication)),
+		KmsKeyId:                         input.KmsKeyId,
+		ServerlessV2ScalingConfiguration: fakeScaling(input.ServerlessV2ScalingConfiguration),
+		StorageEncrypted:                 s.snapshot.StorageEncrypted,
+	}, input.Tags)
+
+	return &neptune.RestoreDBClusterFromSnapshotOutput{DBCluster: f.describeCluster(c)}, nil
+}
+
+// RestoreDBClusterToPointInTime simulates neptune.RestoreDBClusterToPointInTime
+func (f *FakeNeptune) RestoreDBClusterToPointInTime(input *neptune.RestoreDBClusterToPointInTimeInput) (*neptune.RestoreDBClusterToPointInTimeOutput, error) {
+	f.Lock()
+	defer f.Unlock()
+	f.settle()
+
+	name := aws.StringValue(input.DBClusterIdentifier)
+	if _, ok := f.clusters[name]; ok {
+		return nil, awserr.New(neptune.ErrCodeDBClusterAlreadyExistsFault, "DB Cluster already exists", nil)
+	}
+	source, ok := f.clusters[aws.StringValue(input.SourceDBClusterIdentifier)]
+	if !ok {
+		return nil, awserr.New(neptune.ErrCodeDBClusterNotFoundFault, "DBCluster "+aws.StringValue(input.SourceDBClusterIdentifier)+" not found", nil)
+	}
+	if source.status != "available" {
+		return nil, awserr.New(neptune.ErrCodeInvalidDBClusterStateFault, "DBCluster is not in the available state", nil)
+	}
+	if input.RestoreToTime != nil && (input.RestoreToTime.Before(*source.cluster.ClusterCreateTime) || input.RestoreToTime.After(time.Now())) {
+		return nil, awserr.New(neptune.ErrCodeInvalidRestoreFault, "Restore time is outside the restorable window", nil)
+	}
+
+	c := f.addCluster(neptune.DBCluster{
+		DBClusterIdentifier:              aws.String(name),
+		DBClusterParameterGroup:          input.DBClusterParameterGroupName,
+		DBSubnetGroup:                    input.DBSubnetGroupName,
+		DeletionProtection:               aws.Bool(aws.BoolValue(input.DeletionProtection)),
+		Engine:                           source.cluster.Engine,
+		EngineVersion:                    source.cluster.EngineVersion,
+		IAMDatabaseAuthenticationEnabled: aws.Bool(aws.BoolValue(input.EnableIAMDatabaseAuthentication)),
+		KmsKeyId:                         input.KmsKeyId,
+		ServerlessV2ScalingConfiguration: fakeScaling(input.ServerlessV2ScalingConfiguration),
+		StorageEncrypted:                 source.cluster.StorageEncrypted,
+	}, input.Tags)
+
+	return &neptune.RestoreDBClusterToPointInTimeOutput{DBCluster: f.describeCluster(c)}, nil
+}
+
+// StopDBCluster simulates neptune.StopDBCluster, stopping the cluster and its instances
+func (f *FakeNeptune) StopDBCluster(input *neptune.StopDBClusterInput) (*neptune.StopDBClusterOutput, error) {
+	f.Lock()
+	defer f.Unlock()
+	f.settle()
+
+	c, ok := f.clusters[aws.StringValue(input.DBClusterIdentifier)]
+	if !ok {
+		return nil, awserr.New(neptune.ErrCodeDBClusterNotFoundFault, "DBCluster "+aws.StringValue(input.DBClusterIdentifier)+" not found", nil)
+	}
+	if c.status != "available" {
+		return nil, awserr.New(neptune.ErrCodeInvalidDBClusterStateFault, "DbCluster "+aws.StringValue(input.DBClusterIdentifier)+" is in "+c.status+" state but expected it to be available", nil)
+	}
+
+	c.set("stopping", "stopped", f.delay)
+	for _, m := range c.cluster.DBClusterMembers {
+		if i, ok := f.instances[*m.DBInstanceIdentifier]; ok {
+			i.set("stopping", "stopped", f.delay)
+		}
+	}
+	return &neptune.StopDBClusterOutput{DBCluster: f.describeCluster(c)}, nil
+}
+
+// StartDBCluster simulates neptune.StartDBCluster, starting the cluster and its instances
+func (f *FakeNeptune) StartDBCluster(input *neptune.StartDBClusterInput) (*neptune.StartDBClusterOutput, error) {
+	f.Lock()
+	defer f.Unlock()
+	f.settle()
+
+	c, ok := f.clusters[aws.StringValue(input.DBClusterIdentifier)]
+	if !ok {
+		return nil, awserr.New(neptune.ErrCodeDBClusterNotFoundFault, "DBCluster "+aws.StringValue(input.DBClusterIdentifier)+" not found", nil)
+	}
+	if c.status != "stopped" {
+		return nil, awserr.New(neptune.ErrCodeInvalidDBClusterStateFault, "DbCluster "+aws.StringValue(input.DBClusterIdentifier)+" is in "+c.status+" state but expected it to be stopped", nil)
+	}
+
+	c.set("starting", "available", f.delay)
+	for _, m := range c.cluster.DBClusterMembers {
+		if i, ok := f.instances[*m.DBInstanceIdentifier]; ok {
+			i.set("starting", "available", f.delay)
+		}
+	}
+	return &neptune.StartDBClusterOutput{DBCluster: f.describeCluster(c)}, nil
+}
+
+// RebootDBInstance simulates neptune.RebootDBInstance
+func (f *FakeNeptune) RebootDBInstance(input *neptune.RebootDBInstanceInput) (*neptune.RebootDBInstanceOutput, error) {
+	f.Lock()
+	defer f.Unlock()
+	f.settle()
+
+	i, ok := f.instances[aws.StringValue(input.DBInstanceIdentifier)]
+	if !ok {
+		return nil, awserr.New(neptune.ErrCodeDBInstanceNotFoundFault, "DBInstance "+aws.StringValue(input.DBInstanceIdentifier)+" not found", nil)
+	}
+	if i.status != "available" {
+		return nil, awserr.New(neptune.ErrCodeInvalidDBInstanceStateFault, "DBInstance "+aws.StringValue(input.DBInstanceIdentifier)+" is in "+i.status+" state but expected it to be available", nil)
+	}
+
+	i.set("rebooting", "available", f.delay)
+	return &neptune.RebootDBInstanceOutput{DBInstance: f.describeInstance(i)}, nil
+}
+
+// FailoverDBCluster simulates neptune.FailoverDBCluster. The target, or else the reader with the
+// highest priority, becomes the writer right away while the cluster reports "failing-over" for
+// the delay.
+func (f *FakeNeptune) FailoverDBCluster(input *neptune.FailoverDBClusterInput) (*neptune.FailoverDBClusterOutput, error) {
+	f.Lock()
+	defer f.Unlock()
+	f.settle()
+
+	c, ok := f.clusters[aws.StringValue(input.DBClusterIdentifier)]
+	if !ok {
+		return nil, awserr.New(neptune.ErrCodeDBClusterNotFoundFault, "DBCluster "+aws.StringValue(input.DBClusterIdentifier)+" not found", nil)
+	}
+	if c.status != "available" {
+		return nil, awserr.New(neptune.ErrCodeInvalidDBClusterStateFault, "DbCluster "+aws.StringValue(input.DBClusterIdentifier)+" is in "+c.status+" state but expected it to be available", nil)
+	}
+
+	target := aws.StringValue(input.TargetDBInstanceIdentifier)
+	var promoted *neptune.DBClusterMember
+	for _, m := range c.cluster.DBClusterMembers {
+		if aws.BoolValue(m.IsClusterWriter) {
+			continue
+		}
+		if i, ok := f.instances[*m.DBInstanceIdentifier]; !ok || i.status != "available" {
+			continue
+		}
+		if target != "" {
+			if *m.DBInstanceIdentifier == target {
+				promoted = m
+			}
+		} else if promoted == nil || aws.Int64Value(m.PromotionTier) < aws.Int64Value(promoted.PromotionTier) {
+			promoted = m
+		}
+	}
+	if promoted == nil {
+		if target != "" {
+			return nil, awserr.New("InvalidParameterValue", "Target instance "+target+" is not an available reader of the cluster", nil)
+		}
+		return nil, awserr.New(neptune.ErrCodeInvalidDBClusterStateFault, "DbCluster "+aws.StringValue(input.DBClusterIdentifier)+" has no available reader to fail over to", nil)
+	}
+
+	for _, m := range c.cluster.DBClusterMembers {
+		m.IsClusterWriter = aws.Bool(m == promoted)
+	}
+	c.set("failing-over", "available", f.delay)
+	return &neptune.FailoverDBClusterOutput{DBCluster: f.describeCluster(c)}, nil
+}
+
+// DescribeDBSubnetGroups simulates neptune.DescribeDBSubnetGroups. Every subnet group exists
+// and has a subnet in each of the first three availability zones of the region.
+func (f *FakeNeptune) DescribeDBSubnetGroups(input *neptune.DescribeDBSubnetGroupsInput) (*neptune.DescribeDBSubnetGroupsOutput, error) {
+	name := aws.StringValue(input.DBSubnetGroupName)
+	if name == "" {
+		name = "default"
+	}
+
+	group := &neptune.DBSubnetGroup{
+		DBSubnetGroupName: aws.String(name),
+		VpcId:             aws.String("vpc-fake"),
+	}
+	for _, zone := range []string{"a", "b", "c"} {
+		group.Subnets = append(group.Subnets, &neptune.Subnet{
+			SubnetAvailabilityZone: &neptune.AvailabilityZone{Name: aws.String(os.Getenv("REGION") + zone)},
+			SubnetIdentifier:       aws.String("subnet-fake" + zone),
+			SubnetStatus:           aws.String("Active"),
+		})
+	}
+	return &neptune.DescribeDBSubnetGroupsOutput{DBSubnetGroups: []*neptune.DBSubnetGroup{group}}, nil
+}
+
+// exists reports whether a cluster or instance with the given ARN exists
+func (f *FakeNeptune) exists(arn string) bool {
+	for _, c := range f.clusters {
+		if *c.cluster.DBClusterArn == arn {
+			return true
+		}
+	}
+	for _, i := range f.instances {
+		if *i.instance.DBInstanceArn == arn {
+			return true
+		}
+	}
+	return false
+}
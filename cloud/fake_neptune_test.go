@@ -0,0 +1,71 @@
+package cloud
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/neptune"
+)
+
+func clusterStatus(t *testing.T, f *FakeNeptune, name string) string {
+	resp, err := f.DescribeDBClusters(&neptune.DescribeDBClustersInput{DBClusterIdentifier: aws.String(name)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return aws.StringValue(resp.DBClusters[0].Status)
+}
+
+func TestFakeNeptuneLifecycle(t *testing.T) {
+	f := NewFakeNeptune(0)
+
+	cluster, err := f.CreateDBCluster(&neptune.CreateDBClusterInput{DBClusterIdentifier: aws.String("test")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status := aws.StringValue(cluster.DBCluster.Status); status != "creating" {
+		t.Errorf("new cluster is %s, expected creating", status)
+	}
+	if status := clusterStatus(t, f, "test"); status != "available" {
+		t.Errorf("cluster is %s after the delay, expected available", status)
+	}
+
+	_, err = f.CreateDBInstance(&neptune.CreateDBInstanceInput{DBClusterIdentifier: aws.String("test"), DBInstanceIdentifier: aws.String("test")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.CreateDBInstance(&neptune.CreateDBInstanceInput{DBClusterIdentifier: aws.String("test"), DBInstanceIdentifier: aws.String("test")})
+	if aerr, ok := err.(awserr.Error); !ok || aerr.Code() != neptune.ErrCodeDBInstanceAlreadyExistsFault {
+		t.Errorf("creating a duplicate instance returned %v", err)
+	}
+
+	_, err = f.DeleteDBInstance(&neptune.DeleteDBInstanceInput{DBInstanceIdentifier: aws.String("test")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.DeleteDBCluster(&neptune.DeleteDBClusterInput{DBClusterIdentifier: aws.String("test"), SkipFinalSnapshot: aws.Bool(true)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.DescribeDBClusters(&neptune.DescribeDBClustersInput{DBClusterIdentifier: aws.String("test")})
+	if aerr, ok := err.(awserr.Error); !ok || aerr.Code() != neptune.ErrCodeDBClusterNotFoundFault {
+		t.Errorf("describing a deleted cluster returned %v", err)
+	}
+}
+
+func TestFakeNeptuneDelay(t *testing.T) {
+	f := NewFakeNeptune(time.Hour)
+
+	_, err := f.CreateDBCluster(&neptune.CreateDBClusterInput{DBClusterIdentifier: aws.String("test")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status := clusterStatus(t, f, "test"); status != "creating" {
+		t.Errorf("cluster is %s before the delay, expected creating", status)
+	}
+	_, err = f.StopDBCluster(&neptune.StopDBClusterInput{DBClusterIdentifier: aws.String("test")})
+	if aerr, ok := err.(awserr.Error); !ok || aerr.Code() != neptune.ErrCodeInvalidDBClusterStateFault {
+		t.Errorf("stopping a cluster that is creating returned %v", err)
+	}
+}
@@ -0,0 +1,293 @@
+package credentials
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+
+	cloud "neptune-aws-api/cloud"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/iam"
+)
+
+// NeptuneUser is an IAM user and access key used to connect to a cluster
+type NeptuneUser struct {
+	Username  string
+	Arn       string
+	Accesskey string
+	Secretkey string
+}
+
+// SimpleUserPolicy is an IAM policy created for a user
+type SimpleUserPolicy struct {
+	PolicyName string
+	Arn        string
+}
+
+// UserPolicy is an IAM policy document
+type UserPolicy struct {
+	Statement []UserPolicyStatement `json:"Statement"`
+	Version   string                `json:"Version"`
+}
+
+// UserPolicyStatement is a statement in an IAM policy document
+type UserPolicyStatement struct {
+	Resource []string `json:"Resource"`
+	Action   []string `json:"Action"`
+	Effect   string   `json:"Effect"`
+}
+
+// CreateUser creates an IAM user
+func CreateUser(username string) (NeptuneUser, error) {
+	var neptuneuser NeptuneUser
+
+	svc := cloud.IAM()
+
+	params := &iam.CreateUserInput{
+		UserName: aws.String(username),
+	}
+	resp, err := svc.CreateUser(params)
+
+	if err != nil {
+		return neptuneuser, err
+	}
+
+	neptuneuser.Username = username
+	neptuneuser.Arn = *resp.User.Arn
+	return neptuneuser, nil
+
+}
+
+// CreateAccessKey creates an access key for an IAM user
+func CreateAccessKey(username string) (accesskey string, secretkey string, err error) {
+	svc := cloud.IAM()
+
+	paramskey := &iam.CreateAccessKeyInput{
+		UserName: aws.String(username),
+	}
+	respkey, err := svc.CreateAccessKey(paramskey)
+
+	if err != nil {
+		return "", "", err
+	}
+
+	return *respkey.AccessKey.AccessKeyId, *respkey.AccessKey.SecretAccessKey, nil
+}
+
+// CreateUserPolicy creates a policy named after the user that allows every Neptune action on a cluster
+func CreateUserPolicy(username string, resourceID string) (SimpleUserPolicy, error) {
+	var simpleuserpolicy SimpleUserPolicy
+
+	var userpolicy UserPolicy
+	userpolicy.Version = "2012-10-17"
+	var statements []UserPolicyStatement
+	var statement UserPolicyStatement
+	statement.Effect = "Allow"
+	var resources []string
+	resources = append(resources, "arn:aws:neptune-db:"+os.Getenv("REGION")+":"+os.Getenv("ACCOUNTNUMBER")+":"+resourceID+"/*")
+	resources = append(resources, "arn:aws:neptune-db:"+os.Getenv("REGION")+":"+os.Getenv("ACCOUNTNUMBER")+":"+resourceID)
+	statement.Resource = resources
+	var actions []string
+	actions = append(actions, "neptune-db:*")
+	statement.Action = actions
+	statements = append(statements, statement)
+	userpolicy.Statement = statements
+	str, err := json.Marshal(userpolicy)
+	if err != nil {
+		return simpleuserpolicy, errors.New("Error preparing request: " + err.Error())
+	}
+	jsonStr := (string(str))
+
+	svc := cloud.IAM()
+
+	params := &iam.CreatePolicyInput{
+		PolicyDocument: aws.String(jsonStr),
+		PolicyName:     aws.String(username + "policy"),
+	}
+	resp, err := svc.CreatePolicy(params)
+
+	if err != nil {
+		return simpleuserpolicy, err
+	}
+
+	simpleuserpolicy.PolicyName = *resp.Policy.PolicyName
+	simpleuserpolicy.Arn = *resp.Policy.Arn
+	return simpleuserpolicy, nil
+}
+
+// AttachUserPolicy attaches a policy to an IAM user
+func AttachUserPolicy(username string, simpleuserpolicy SimpleUserPolicy) error {
+	svc := cloud.IAM()
+
+	params := &iam.AttachUserPolicyInput{
+		PolicyArn: aws.String(simpleuserpolicy.Arn),
+		UserName:  aws.String(username),
+	}
+	_, err := svc.AttachUserPolicy(params)
+	return err
+}
+
+// DetachUserPolicy detaches a policy from an IAM user
+func DetachUserPolicy(username string, policyarn string) error {
+	svc := cloud.IAM()
+
+	params := &iam.DetachUserPolicyInput{
+		PolicyArn: aws.String(policyarn),
+		UserName:  aws.String(username),
+	}
+	_, err := svc.DetachUserPolicy(params)
+	return err
+}
+
+// DeletePolicy deletes an IAM policy
+func DeletePolicy(policyarn string) error {
+	svc := cloud.IAM()
+
+	params := &iam.DeletePolicyInput{
+		PolicyArn: aws.String(policyarn),
+	}
+	_, err := svc.DeletePolicy(params)
+	return err
+}
+
+// DeleteAccessKey deletes an access key of an IAM user
+func DeleteAccessKey(username string, accesskeyid string) error {
+	svc := cloud.IAM()
+
+	params := &iam.DeleteAccessKeyInput{
+		AccessKeyId: aws.String(accesskeyid),
+		UserName:    aws.String(username),
+	}
+	_, err := svc.DeleteAccessKey(params)
+	return err
+}
+
+// DeleteUser deletes an IAM user, which must not have access keys or attached policies
+func DeleteUser(username string) error {
+	svc := cloud.IAM()
+
+	params := &iam.DeleteUserInput{
+		UserName: aws.String(username),
+	}
+	_, err := svc.DeleteUser(params)
+	return err
+}
+
+// Create creates an IAM user with an access key and a policy scoped to a cluster. If any
+// part fails, whatever was already created is removed again.
+func Create(username string, resourceID string) (NeptuneUser, error) {
+	user, err := CreateUser(username)
+	if err != nil {
+		return user, err
+	}
+
+	user.Accesskey, user.Secretkey, err = CreateAccessKey(username)
+	if err != nil {
+		DeleteUser(username)
+		return user, err
+	}
+
+	policy, err := CreateUserPolicy(username, resourceID)
+	if err != nil {
+		DeleteAccessKey(username, user.Accesskey)
+		DeleteUser(username)
+		return user, err
+	}
+
+	err = AttachUserPolicy(username, policy)
+	if err != nil {
+		DeletePolicy(policy.Arn)
+		DeleteAccessKey(username, user.Accesskey)
+		DeleteUser(username)
+		return user, err
+	}
+
+	return user, nil
+}
+
+// Remove detaches and deletes the policies of an IAM user, deletes its access keys and then
+// the user itself. Anything that no longer exists is skipped, so it is safe to retry.
+func Remove(username string) error {
+	svc := cloud.IAM()
+
+	attached, err := svc.ListAttachedUserPolicies(&iam.ListAttachedUserPoliciesInput{UserName: aws.String(username)})
+	if IsNotFound(err) {
+		return deleteUserPolicy(username)
+	} else if err != nil {
+		return err
+	}
+	for _, policy := range attached.AttachedPolicies {
+		err = DetachUserPolicy(username, *policy.PolicyArn)
+		if err != nil && !IsNotFound(err) {
+			return err
+		}
+		err = DeletePolicy(*policy.PolicyArn)
+		if err != nil && !IsNotFound(err) {
+			return err
+		}
+	}
+
+	keys, err := svc.ListAccessKeys(&iam.ListAccessKeysInput{UserName: aws.String(username)})
+	if err != nil && !IsNotFound(err) {
+		return err
+	}
+	if keys != nil {
+		for _, key := range keys.AccessKeyMetadata {
+			err = DeleteAccessKey(username, *key.AccessKeyId)
+			if err != nil && !IsNotFound(err) {
+				return err
+			}
+		}
+	}
+
+	err = DeleteUser(username)
+	if err != nil && !IsNotFound(err) {
+		return err
+	}
+	return deleteUserPolicy(username)
+}
+
+// Delete the policy named after a user, which is left behind if it was never attached
+func deleteUserPolicy(username string) error {
+	err := DeletePolicy("arn:aws:iam::" + os.Getenv("ACCOUNTNUMBER") + ":policy/" + username + "policy")
+	if err != nil && !IsNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+// SetKeysActive activates or deactivates every access key of an IAM user
+func SetKeysActive(username string, active bool) error {
+	svc := cloud.IAM()
+
+	status := iam.StatusTypeInactive
+	if active {
+		status = iam.StatusTypeActive
+	}
+
+	keys, err := svc.ListAccessKeys(&iam.ListAccessKeysInput{UserName: aws.String(username)})
+	if err != nil {
+		return err
+	}
+	for _, key := range keys.AccessKeyMetadata {
+		_, err = svc.UpdateAccessKey(&iam.UpdateAccessKeyInput{
+			AccessKeyId: key.AccessKeyId,
+			Status:      aws.String(status),
+			UserName:    aws.String(username),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// IsNotFound returns whether an IAM error means the entity does not exist
+func IsNotFound(err error) bool {
+	if aerr, ok := err.(awserr.Error); ok {
+		return aerr.Code() == iam.ErrCodeNoSuchEntityException
+	}
+	return false
+}
@@ -0,0 +1,91 @@
+package lifecycle
+
+import (
+	"database/sql"
+	"errors"
+)
+
+// States a provision row moves through
+const (
+	Creating        = "creating"         // Cluster and instance requested, waiting for AWS
+	IAMPending      = "iam_pending"      // Instance available, IAM user, key and policy being set up
+	Available       = "available"        // Ready to be claimed
+	Claimed         = "claimed"          // In use by an app
+	Stopped         = "stopped"          // Claimed, with its cluster stopped by its owner
+	Starting        = "starting"         // Claimed, waiting for its cluster to start again
+	PendingDeletion = "pending_deletion" // Deleted by its app, stopped and kept until its retention period ends
+	Deleting        = "deleting"         // Deletion requested, waiting for AWS
+	Deleted         = "deleted"          // Cluster and instance no longer exist
+	Failed          = "failed"           // Provisioning or deletion failed
+)
+
+var transitions = map[string][]string{
+	Creating:        {IAMPending, Deleting, Failed},
+	IAMPending:      {Available, Claimed, Deleting, Failed}, // Instances restored from a snapshot are claimed directly
+	Available:       {Claimed, Deleting, Failed},
+	Claimed:         {Stopped, PendingDeletion, Deleting, Failed},
+	Stopped:         {Starting, Claimed, PendingDeletion, Deleting, Failed}, // A stop that AWS refuses is undone
+	Starting:        {Claimed, Deleting, Failed},
+	PendingDeletion: {Starting, Deleting, Failed},
+	Deleting:        {Deleted, Failed},
+	Failed:          {Deleting},
+	Deleted:         {},
+}
+
+// ErrInvalidTransition is returned when a row may not move between two states
+var ErrInvalidTransition = errors.New("Invalid state transition")
+
+// ErrStateChanged is returned when a row is no longer in the state it was expected to be in
+var ErrStateChanged = errors.New("Instance state changed, try again")
+
+// Execer is satisfied by both *sql.DB and *sql.Tx
+type Execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// Allowed reports whether a row may move from one state to another
+func Allowed(from string, to string) bool {
+	for _, state := range transitions[from] {
+		if state == to {
+			return true
+		}
+	}
+	return false
+}
+
+// Pending reports whether a state counts towards the pool of unclaimed instances
+func Pending(state string) bool {
+	return state == Creating || state == IAMPending || state == Available
+}
+
+// Transition moves a row from one state to another and records when it happened in
+// provision_history. It fails with ErrStateChanged if the row is not in the from state.
+func Transition(db Execer, name string, from string, to string) error {
+	if !Allowed(from, to) {
+		return errors.New(ErrInvalidTransition.Error() + " from " + from + " to " + to)
+	}
+
+	result, err := db.Exec(`
+		WITH moved AS (
+			UPDATE provision SET state=$1 WHERE name=$2 AND state=$3 RETURNING name
+		)
+		INSERT INTO provision_history(name, fromstate, tostate) SELECT name, $3, $1 FROM moved`, to, name, from)
+	if err != nil {
+		return err
+	}
+
+	moved, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if moved == 0 {
+		return ErrStateChanged
+	}
+	return nil
+}
+
+// Record inserts the first provision_history entry of a new row
+func Record(db Execer, name string, state string) error {
+	_, err := db.Exec("INSERT INTO provision_history(name, fromstate, tostate) VALUES ($1, NULL, $2)", name, state)
+	return err
+}
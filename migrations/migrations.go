@@ -0,0 +1,457 @@
+package migrations
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+type migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// Status is the applied state of a single migration
+type Status struct {
+	Version int
+	Name    string
+	Applied *time.Time
+}
+
+// Migrations are applied in order and must never be edited once released, add a new one instead
+var migrations = []migration{
+	{
+		Version: 1,
+		Name:    "create provision table",
+		Up: `
+			CREATE TABLE if not exists provision (
+				name character varying(200) PRIMARY KEY,
+				plan character varying(200),
+				claimed character varying(200),
+				makeDate timestamp without time zone DEFAULT now(),
+				billingcode character varying(200),
+				endpoint character varying(200),
+				accesskey character varying(200),
+				secretkey character varying(200)
+			);
+
+			CREATE UNIQUE INDEX if not exists name_pkey ON provision(name text_ops);`,
+		Down: `DROP TABLE provision;`,
+	},
+	{
+		Version: 2,
+		Name:    "add service broker instance id",
+		Up: `
+			ALTER TABLE provision ADD COLUMN if not exists instanceid character varying(200);
+			CREATE UNIQUE INDEX if not exists instanceid_key ON provision(instanceid);`,
+		Down: `
+			DROP INDEX if exists instanceid_key;
+			ALTER TABLE provision DROP COLUMN if exists instanceid;`,
+	},
+	{
+		Version: 3,
+		Name:    "add lifecycle state",
+		Up: `
+			ALTER TABLE provision ADD COLUMN if not exists state character varying(200);
+			UPDATE provision SET state = CASE
+				WHEN claimed = 'yes' THEN 'claimed'
+				WHEN coalesce(endpoint, '') = '' THEN 'creating'
+				ELSE 'available' END
+			WHERE state IS NULL;
+			CREATE INDEX if not exists provision_state ON provision(state);
+
+			CREATE TABLE if not exists provision_history (
+				id serial PRIMARY KEY,
+				name character varying(200) NOT NULL,
+				fromstate character varying(200),
+				tostate character varying(200) NOT NULL,
+				changed timestamp without time zone DEFAULT now()
+			);
+
+			CREATE INDEX if not exists provision_history_name ON provision_history(name);`,
+		Down: `
+			DROP TABLE if exists provision_history;
+			UPDATE provision SET claimed = CASE WHEN state = 'available' OR state = 'creating' OR state = 'iam_pending' THEN 'no' ELSE 'yes' END;
+			DELETE FROM provision WHERE state = 'deleted';
+			DROP INDEX if exists provision_state;
+			ALTER TABLE provision DROP COLUMN if exists state;`,
+	},
+	{
+		Version: 4,
+		Name:    "add provisioning steps",
+		Up: `
+			CREATE TABLE if not exists provision_steps (
+				id serial PRIMARY KEY,
+				name character varying(200) NOT NULL,
+				step character varying(200) NOT NULL,
+				action character varying(20) NOT NULL,
+				status character varying(20) NOT NULL,
+				error text,
+				at timestamp without time zone DEFAULT now()
+			);
+
+			CREATE INDEX if not exists provision_steps_name ON provision_steps(name);`,
+		Down: `DROP TABLE if exists provision_steps;`,
+	},
+	{
+		Version: 5,
+		Name:    "add bindings",
+		Up: `
+			CREATE TABLE if not exists bindings (
+				id character varying(200) PRIMARY KEY,
+				name character varying(200) NOT NULL REFERENCES provision(name),
+				username character varying(200) NOT NULL,
+				accesskey character varying(200),
+				created timestamp without time zone DEFAULT now()
+			);
+
+			CREATE INDEX if not exists bindings_name ON bindings(name);`,
+		Down: `DROP TABLE if exists bindings;`,
+	},
+	{
+		Version: 6,
+		Name:    "add access key rotations",
+		Up: `
+			ALTER TABLE provision ADD COLUMN if not exists keycreated timestamp without time zone;
+			UPDATE provision SET keycreated = makedate WHERE coalesce(accesskey, '') <> '' AND keycreated IS NULL;
+
+			CREATE TABLE if not exists rotations (
+				id serial PRIMARY KEY,
+				name character varying(200) NOT NULL REFERENCES provision(name),
+				oldkey character varying(200) NOT NULL,
+				newkey character varying(200) NOT NULL,
+				status character varying(200) NOT NULL,
+				error text,
+				created timestamp without time zone DEFAULT now(),
+				deleteafter timestamp without time zone NOT NULL,
+				finished timestamp without time zone
+			);
+
+			CREATE INDEX if not exists rotations_status ON rotations(status, deleteafter);`,
+		Down: `
+			DROP TABLE if exists rotations;
+			ALTER TABLE provision DROP COLUMN if exists keycreated;`,
+	},
+	{
+		Version: 7,
+		Name:    "widen secretkey for encrypted values",
+		Up:      `ALTER TABLE provision ALTER COLUMN secretkey TYPE text;`,
+		Down:    `ALTER TABLE provision ALTER COLUMN secretkey TYPE character varying(200);`,
+	},
+	{
+		Version: 8,
+		Name:    "add snapshots",
+		Up: `
+			CREATE TABLE if not exists snapshots (
+				id character varying(200) PRIMARY KEY,
+				name character varying(200) NOT NULL REFERENCES provision(name),
+				billingcode character varying(200),
+				status character varying(200) NOT NULL,
+				created timestamp without time zone DEFAULT now()
+			);
+
+			CREATE INDEX if not exists snapshots_name ON snapshots(name);
+			CREATE INDEX if not exists snapshots_status ON snapshots(status);`,
+		Down: `DROP TABLE if exists snapshots;`,
+	},
+	{
+		Version: 9,
+		Name:    "add instance source",
+		Up:      `ALTER TABLE provision ADD COLUMN if not exists source character varying(200);`,
+		Down:    `ALTER TABLE provision DROP COLUMN if exists source;`,
+	},
+	{
+		Version: 10,
+		Name:    "add deletion protection and final snapshot",
+		Up: `
+			ALTER TABLE provision ADD COLUMN if not exists deletionprotection boolean NOT NULL DEFAULT false;
+			ALTER TABLE provision ADD COLUMN if not exists finalsnapshot character varying(200);`,
+		Down: `
+			ALTER TABLE provision DROP COLUMN if exists finalsnapshot;
+			ALTER TABLE provision DROP COLUMN if exists deletionprotection;`,
+	},
+	{
+		Version: 11,
+		Name:    "add soft delete retention",
+		Up:      `ALTER TABLE provision ADD COLUMN if not exists deleteafter timestamp without time zone;`,
+		Down: `
+			UPDATE provision SET state = 'claimed' WHERE state = 'pending_deletion';
+			ALTER TABLE provision DROP COLUMN if exists deleteafter;`,
+	},
+	{
+		Version: 12,
+		Name:    "add iam teardown jobs",
+		Up: `
+			CREATE TABLE if not exists teardowns (
+				id serial PRIMARY KEY,
+				name character varying(200) NOT NULL REFERENCES provision(name),
+				username character varying(200) NOT NULL,
+				status character varying(200) NOT NULL,
+				attempts integer NOT NULL DEFAULT 0,
+				error text,
+				created timestamp without time zone DEFAULT now(),
+				nextattempt timestamp without time zone NOT NULL DEFAULT now(),
+				finished timestamp without time zone
+			);
+
+			CREATE INDEX if not exists teardowns_status ON teardowns(status, nextattempt);`,
+		Down: `DROP TABLE if exists teardowns;`,
+	},
+	{
+		Version: 13,
+		Name:    "add instance tags",
+		Up: `
+			CREATE TABLE if not exists tags (
+				name character varying(200) NOT NULL REFERENCES provision(name),
+				key character varying(200) NOT NULL,
+				value character varying(200) NOT NULL,
+				PRIMARY KEY (name, key)
+			);`,
+		Down: `DROP TABLE if exists tags;`,
+	},
+	{
+		Version: 14,
+		Name:    "add plan changes",
+		Up: `
+			CREATE TABLE if not exists plan_changes (
+				id serial PRIMARY KEY,
+				name character varying(200) NOT NULL REFERENCES provision(name),
+				oldplan character varying(200) NOT NULL,
+				newplan character varying(200) NOT NULL,
+				instanceclass character varying(200) NOT NULL,
+				applyimmediately boolean NOT NULL,
+				status character varying(200) NOT NULL,
+				error text,
+				created timestamp without time zone DEFAULT now(),
+				finished timestamp without time zone
+			);
+
+			CREATE INDEX if not exists plan_changes_status ON plan_changes(status);`,
+		Down: `DROP TABLE if exists plan_changes;`,
+	},
+	{
+		Version: 15,
+		Name:    "add read replicas",
+		Up: `
+			CREATE TABLE if not exists replicas (
+				id character varying(200) PRIMARY KEY,
+				name character varying(200) NOT NULL REFERENCES provision(name),
+				instanceclass character varying(200) NOT NULL,
+				status character varying(200) NOT NULL,
+				created timestamp without time zone DEFAULT now()
+			);`,
+		Down: `DROP TABLE if exists replicas;`,
+	},
+	{
+		Version: 16,
+		Name:    "add autoscaling audit",
+		Up: `
+			CREATE TABLE if not exists autoscale_events (
+				id serial PRIMARY KEY,
+				name character varying(200) NOT NULL REFERENCES provision(name),
+				metric character varying(200) NOT NULL,
+				value double precision,
+				target double precision NOT NULL,
+				replicas integer NOT NULL,
+				desired integer NOT NULL,
+				action character varying(200) NOT NULL,
+				reason text,
+				replica character varying(200),
+				error text,
+				created timestamp without time zone DEFAULT now()
+			);
+
+			CREATE INDEX if not exists autoscale_events_name ON autoscale_events(name, created);`,
+		Down: `DROP TABLE if exists autoscale_events;`,
+	},
+	{
+		Version: 17,
+		Name:    "add service broker bindings",
+		Up: `
+			ALTER TABLE bindings ADD COLUMN if not exists osbid character varying(200);
+			ALTER TABLE bindings ADD COLUMN if not exists parameters text;
+			ALTER TABLE bindings ADD COLUMN if not exists secretkey text;
+
+			CREATE UNIQUE INDEX if not exists bindings_osbid ON bindings(osbid);`,
+		Down: `
+			DROP INDEX if exists bindings_osbid;
+			ALTER TABLE bindings DROP COLUMN if exists secretkey;
+			ALTER TABLE bindings DROP COLUMN if exists parameters;
+			ALTER TABLE bindings DROP COLUMN if exists osbid;`,
+	},
+	{
+		Version: 18,
+		Name:    "allow reusing instance ids of deleted instances",
+		Up: `
+			DROP INDEX if exists instanceid_key;
+			CREATE UNIQUE INDEX if not exists instanceid_key ON provision(instanceid) WHERE state NOT IN ('deleted', 'pending_deletion');`,
+		Down: `
+			DROP INDEX if exists instanceid_key;
+			UPDATE provision SET instanceid = NULL WHERE state = 'deleted';
+			CREATE UNIQUE INDEX if not exists instanceid_key ON provision(instanceid);`,
+	},
+	{
+		Version: 19,
+		Name:    "widen access key columns for encrypted values",
+		Up: `
+			ALTER TABLE provision ALTER COLUMN accesskey TYPE text;
+			ALTER TABLE bindings ALTER COLUMN accesskey TYPE text;
+			ALTER TABLE rotations ALTER COLUMN oldkey TYPE text;
+			ALTER TABLE rotations ALTER COLUMN newkey TYPE text;`,
+		Down: `
+			ALTER TABLE rotations ALTER COLUMN newkey TYPE character varying(200);
+			ALTER TABLE rotations ALTER COLUMN oldkey TYPE character varying(200);
+			ALTER TABLE bindings ALTER COLUMN accesskey TYPE character varying(200);
+			ALTER TABLE provision ALTER COLUMN accesskey TYPE character varying(200);`,
+	},
+}
+
+// Latest returns the schema version the code expects
+func Latest() int {
+	return migrations[len(migrations)-1].Version
+}
+
+func ensureTable(db *sql.DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE if not exists schema_migrations (
+			version integer PRIMARY KEY,
+			name character varying(200),
+			applied timestamp without time zone DEFAULT now()
+		);`)
+	return err
+}
+
+// Current returns the version of the newest migration applied to the database, 0 if none
+func Current(db *sql.DB) (int, error) {
+	err := ensureTable(db)
+	if err != nil {
+		return 0, err
+	}
+
+	var version int
+	err = db.QueryRow("SELECT coalesce(max(version), 0) FROM schema_migrations").Scan(&version)
+	return version, err
+}
+
+// Up applies every pending migration, each in its own transaction
+func Up(db *sql.DB) error {
+	current, err := Current(db)
+	if err != nil {
+		return err
+	}
+
+	for _, m := range migrations {
+		if m.Version <= current {
+			continue
+		}
+		fmt.Println("Applying migration " + strconv.Itoa(m.Version) + ": " + m.Name)
+		err = apply(db, m.Version, m.Name, m.Up, true)
+		if err != nil {
+			return errors.New("Migration " + strconv.Itoa(m.Version) + " failed: " + err.Error())
+		}
+	}
+	return nil
+}
+
+// Down reverts the newest applied migration
+func Down(db *sql.DB) error {
+	current, err := Current(db)
+	if err != nil {
+		return err
+	}
+	if current == 0 {
+		return errors.New("No migrations to revert")
+	}
+
+	for i := len(migrations) - 1; i >= 0; i-- {
+		m := migrations[i]
+		if m.Version != current {
+			continue
+		}
+		fmt.Println("Reverting migration " + strconv.Itoa(m.Version) + ": " + m.Name)
+		err = apply(db, m.Version, m.Name, m.Down, false)
+		if err != nil {
+			return errors.New("Reverting migration " + strconv.Itoa(m.Version) + " failed: " + err.Error())
+		}
+		return nil
+	}
+	return errors.New("Database is at unknown schema version " + strconv.Itoa(current))
+}
+
+// Statuses returns every known migration along with when it was applied
+func Statuses(db *sql.DB) ([]Status, error) {
+	err := ensureTable(db)
+	if err != nil {
+		return nil, err
+	}
+
+	applied := make(map[int]time.Time)
+	rows, err := db.Query("SELECT version, applied FROM schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var version int
+		var at time.Time
+		err = rows.Scan(&version, &at)
+		if err != nil {
+			return nil, err
+		}
+		applied[version] = at
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var statuses []Status
+	for _, m := range migrations {
+		status := Status{Version: m.Version, Name: m.Name}
+		if at, ok := applied[m.Version]; ok {
+			status.Applied = &at
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
+
+// Check returns an error if the database schema is older than the code expects
+func Check(db *sql.DB) error {
+	current, err := Current(db)
+	if err != nil {
+		return errors.New("Unable to read schema version: " + err.Error())
+	}
+	if current < Latest() {
+		return errors.New("Database schema is at version " + strconv.Itoa(current) + " but version " + strconv.Itoa(Latest()) + " is required, run 'neptune migrate up'")
+	}
+	return nil
+}
+
+func apply(db *sql.DB, version int, name string, stmt string, up bool) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(stmt)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if up {
+		_, err = tx.Exec("INSERT INTO schema_migrations(version, name) VALUES ($1, $2)", version, name)
+	} else {
+		_, err = tx.Exec("DELETE FROM schema_migrations WHERE version=$1", version)
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
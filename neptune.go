@@ -5,19 +5,29 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"strconv"
 
 	api "neptune-aws-api/api"
+	cloud "neptune-aws-api/cloud"
+	migrations "neptune-aws-api/migrations"
+	plans "neptune-aws-api/plans"
 	preprovision "neptune-aws-api/preprovision"
+	reconcile "neptune-aws-api/reconcile"
+	secrets "neptune-aws-api/secrets"
 
 	_ "github.com/lib/pq"
 	"github.com/robfig/cron"
 )
 
 func main() {
-	if len(os.Args) != 2 || (os.Args[1] != "preprovision" && os.Args[1] != "api") {
-		fmt.Println("Usage: neptune [preprovision | api]")
+	if !validArgs(os.Args) {
+		fmt.Println("Usage: neptune [preprovision | api | local | reconcile [fix] | migrate [up | down | status] | encrypt]")
 		fmt.Println("   api: Run neptune REST API")
 		fmt.Println("   preprovision: Run neptune preprovisioner")
+		fmt.Println("   local: Run neptune REST API and preprovisioner in a single process")
+		fmt.Println("   reconcile: Report drift between the provision table and AWS, and repair it with fix")
+		fmt.Println("   migrate: Apply (up), revert the newest (down) or list (status) database migrations")
+		fmt.Println("   encrypt: Encrypt access key IDs and secret keys that are still stored in plaintext")
 		os.Exit(1)
 	}
 
@@ -27,7 +37,34 @@ func main() {
 		os.Exit(1)
 	}
 
-	err = initDB()
+	if os.Args[1] == "migrate" {
+		err = migrate(os.Args[2])
+		if err != nil {
+			fmt.Println(err.Error())
+			os.Exit(1)
+		}
+		return
+	}
+
+	err = plans.Load(os.Getenv("PLANS_FILE"))
+	if err != nil {
+		fmt.Println(err.Error())
+		os.Exit(1)
+	}
+
+	err = cloud.Init(os.Getenv("CLOUD_PROVIDER"))
+	if err != nil {
+		fmt.Println(err.Error())
+		os.Exit(1)
+	}
+
+	err = secrets.Init(os.Getenv("SECRETS_KEY_FILE"), os.Getenv("KMS_KEY_ID"))
+	if err != nil {
+		fmt.Println(err.Error())
+		os.Exit(1)
+	}
+
+	err = checkSchema()
 	if err != nil {
 		fmt.Println(err.Error())
 		os.Exit(1)
@@ -51,11 +88,74 @@ func main() {
 		fmt.Println("Running in API Mode...")
 		fmt.Println("")
 		api.Run()
+	} else if os.Args[1] == "reconcile" {
+		fmt.Println("Running in Reconcile Mode...")
+		fmt.Println("")
+
+		fix := len(os.Args) == 3 && os.Args[2] == "fix"
+		db, err := openDB()
+		if err != nil {
+			fmt.Println(err.Error())
+			os.Exit(1)
+		}
+		defer db.Close()
+
+		if os.Getenv("RUN_AS_CRON") != "" {
+			fmt.Println("Running as cron job...")
+			fmt.Println("")
+			c := cron.New()
+			c.AddFunc("@every 1h", func() { reconcile.Print(db, fix) })
+			c.Run()
+		} else {
+			reconcile.Print(db, fix)
+		}
+	} else if os.Args[1] == "encrypt" {
+		db, err := openDB()
+		if err != nil {
+			fmt.Println(err.Error())
+			os.Exit(1)
+		}
+		defer db.Close()
+
+		count, err := secrets.EncryptRows(db)
+		if err != nil {
+			fmt.Println(err.Error())
+			os.Exit(1)
+		}
+		fmt.Println("Encrypted " + strconv.Itoa(count) + " access key IDs and secret keys")
+	} else if os.Args[1] == "local" {
+		fmt.Println("Running in Local Mode...")
+		fmt.Println("")
+		c := cron.New()
+		c.AddFunc("@every 1m", preprovision.Run)
+		c.Start()
+		go preprovision.Run()
+		api.Run()
+	}
+}
+
+func validArgs(args []string) bool {
+	if len(args) == 2 {
+		return args[1] == "preprovision" || args[1] == "api" || args[1] == "local" || args[1] == "reconcile" || args[1] == "encrypt"
+	}
+	if len(args) == 3 && args[1] == "reconcile" {
+		return args[2] == "fix"
+	}
+	if len(args) == 3 && args[1] == "migrate" {
+		return args[2] == "up" || args[2] == "down" || args[2] == "status"
 	}
+	return false
 }
 
 func checkEnvironmentVariables(mode string) error {
 
+	if mode == "migrate" {
+		if os.Getenv("BROKER_DB") == "" {
+			return errors.New("Missing BROKER_DB environment variable")
+		}
+		return nil
+	}
+
 	if os.Getenv("REGION") == "" {
 		return errors.New("Missing REGION environment variable")
 	}
@@ -66,10 +166,17 @@ func checkEnvironmentVariables(mode string) error {
 		return errors.New("Missing ACCOUNTNUMBER environment variable")
 	}
 
-	if mode == "preprovision" {
-		if os.Getenv("PROVISION_SMALL") == "" {
-			return errors.New("Missing PROVISION_SMALL environment variable")
+	if os.Getenv("KMS_KEY_ID") == "" && os.Getenv("SECRETS_KEY_FILE") == "" {
+		return errors.New("Missing KMS_KEY_ID or SECRETS_KEY_FILE environment variable")
+	}
+
+	if mode == "reconcile" {
+		if os.Getenv("NAME_PREFIX") == "" {
+			return errors.New("Missing NAME_PREFIX environment variable")
 		}
+	}
+
+	if mode == "preprovision" || mode == "local" {
 		if os.Getenv("NAME_PREFIX") == "" {
 			return errors.New("Missing NAME_PREFIX environment variable")
 		}
@@ -87,31 +194,57 @@ func checkEnvironmentVariables(mode string) error {
 	return nil
 }
 
-func initDB() error {
+func openDB() (*sql.DB, error) {
 	uri := os.Getenv("BROKER_DB")
 	db, err := sql.Open("postgres", uri)
 	if err != nil {
-		return errors.New("Unable to establish database connection: " + err.Error())
+		return nil, errors.New("Unable to establish database connection: " + err.Error())
+	}
+	return db, nil
+}
+
+// Refuse to start against a database that has not been migrated to the latest schema
+func checkSchema() error {
+	db, err := openDB()
+	if err != nil {
+		return err
 	}
 	defer db.Close()
 
-	createStmt := `
-		CREATE TABLE if not exists provision (
-    	name character varying(200) PRIMARY KEY,
-    	plan character varying(200),
-    	claimed character varying(200),
-    	makeDate timestamp without time zone DEFAULT now(),
-    	billingcode character varying(200),
-    	endpoint character varying(200),
-    	accesskey character varying(200),
-    	secretkey character varying(200)
-		);
-		
-		CREATE UNIQUE INDEX if not exists name_pkey ON provision(name text_ops);`
-
-	_, err = db.Exec(createStmt)
+	return migrations.Check(db)
+}
+
+func migrate(command string) error {
+	db, err := openDB()
 	if err != nil {
-		return errors.New("Unable to create database: " + err.Error())
+		return err
+	}
+	defer db.Close()
+
+	switch command {
+	case "up":
+		err = migrations.Up(db)
+		if err != nil {
+			return err
+		}
+		fmt.Println("Database schema is at version " + strconv.Itoa(migrations.Latest()))
+	case "down":
+		err = migrations.Down(db)
+		if err != nil {
+			return err
+		}
+	case "status":
+		statuses, err := migrations.Statuses(db)
+		if err != nil {
+			return err
+		}
+		for _, status := range statuses {
+			applied := "pending"
+			if status.Applied != nil {
+				applied = "applied " + status.Applied.Format("2006-01-02 15:04:05")
+			}
+			fmt.Printf("%4d  %-40s %s\n", status.Version, status.Name, applied)
+		}
 	}
 	return nil
 }
@@ -0,0 +1,200 @@
+package plans
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Plan describes an instance size offered by the broker
+type Plan struct {
+	Name           string       `json:"-"`
+	Description    string       `json:"description"`
+	Price          string       `json:"price"`
+	InstanceClass  string       `json:"instance_class"`
+	PoolTarget     int          `json:"pool_target"`
+	EngineVersion  string       `json:"engine_version"`
+	MultiAZ        bool         `json:"multi_az"`
+	ParameterGroup string       `json:"parameter_group"`
+	Autoscaling    *Autoscaling `json:"autoscaling,omitempty"`
+	Serverless     *Serverless  `json:"serverless,omitempty"`
+}
+
+// Serverless plans use the db.serverless instance class and scale the capacity of their
+// instances between MinCapacity and MaxCapacity Neptune capacity units (NCUs)
+type Serverless struct {
+	MinCapacity float64 `json:"min_capacity"`
+	MaxCapacity float64 `json:"max_capacity"`
+}
+
+// ServerlessInstanceClass is the instance class of every instance of a serverless plan
+const ServerlessInstanceClass = "db.serverless"
+
+// Autoscaling keeps the number of read replicas of claimed instances between MinReplicas and
+// MaxReplicas, adding or removing one at a time to bring Metric close to Target
+type Autoscaling struct {
+	MinReplicas int     `json:"min_replicas"`
+	MaxReplicas int     `json:"max_replicas"`
+	Metric      string  `json:"metric"`
+	Target      float64 `json:"target"`
+	Cooldown    string  `json:"cooldown"`
+}
+
+// Metrics that autoscaling can target, and the CloudWatch metric each is read from
+var Metrics = map[string]string{
+	"cpu":              "CPUUtilization",
+	"gremlin_requests": "GremlinRequestsPerSec",
+	"sparql_requests":  "SparqlRequestsPerSec",
+}
+
+// MaxReplicas is the most read replicas a cluster can have
+const MaxReplicas = 15
+
+const defaultCooldown = 5 * time.Minute
+
+// ErrUnknownPlan is returned when a plan is not defined in the plan file
+var ErrUnknownPlan = errors.New("Unknown plan")
+
+var catalog map[string]Plan
+
+// Load reads the plan definitions from a JSON file, keyed by plan name
+func Load(path string) error {
+	if path == "" {
+		path = "plans.json"
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return errors.New("Unable to read plan file: " + err.Error())
+	}
+
+	loaded := make(map[string]Plan)
+	err = json.Unmarshal(data, &loaded)
+	if err != nil {
+		return errors.New("Unable to parse plan file " + path + ": " + err.Error())
+	}
+	if len(loaded) == 0 {
+		return errors.New("No plans defined in " + path)
+	}
+
+	for name, plan := range loaded {
+		if plan.Serverless != nil {
+			if plan.InstanceClass == "" {
+				plan.InstanceClass = ServerlessInstanceClass
+			} else if plan.InstanceClass != ServerlessInstanceClass {
+				return errors.New("Plan " + name + " is serverless, its instance_class must be " + ServerlessInstanceClass + " or left out")
+			}
+			err = ValidCapacity(plan.Serverless.MinCapacity, plan.Serverless.MaxCapacity)
+			if err != nil {
+				return errors.New("Plan " + name + " has invalid serverless capacity: " + err.Error())
+			}
+		}
+		if plan.InstanceClass == "" {
+			return errors.New("Plan " + name + " is missing instance_class")
+		}
+		if plan.Autoscaling != nil {
+			err = plan.Autoscaling.validate()
+			if err != nil {
+				return errors.New("Plan " + name + " has invalid autoscaling: " + err.Error())
+			}
+			// The reader of a multi-AZ plan is what it fails over to
+			if plan.MultiAZ && plan.Autoscaling.MaxReplicas < 1 {
+				return errors.New("Plan " + name + " has invalid autoscaling: max_replicas must be at least 1 for a multi_az plan")
+			}
+		}
+		plan.Name = name
+		loaded[name] = plan
+	}
+
+	catalog = loaded
+	return nil
+}
+
+// Get returns the definition of a plan
+func Get(name string) (Plan, error) {
+	plan, ok := catalog[name]
+	if !ok {
+		return Plan{}, ErrUnknownPlan
+	}
+	return plan, nil
+}
+
+// Names returns the names of all plans, sorted
+func Names() []string {
+	var names []string
+	for name := range catalog {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Summary returns the human readable description and price of the plan
+func (p Plan) Summary() string {
+	if p.Price == "" {
+		return p.Description
+	}
+	return p.Description + " - " + p.Price
+}
+
+// ValidCapacity returns an error unless min and max are a capacity range Neptune Serverless
+// accepts: between 1 and 128 NCUs in steps of 0.5, min first
+func ValidCapacity(min float64, max float64) error {
+	if min < 1 || max > 128 || min > max {
+		return errors.New("min_capacity and max_capacity must be between 1 and 128, min_capacity first")
+	}
+	if math.Mod(min*2, 1) != 0 || math.Mod(max*2, 1) != 0 {
+		return errors.New("min_capacity and max_capacity must be multiples of 0.5")
+	}
+	return nil
+}
+
+// IsServerless returns whether instances of the plan are serverless
+func (p Plan) IsServerless() bool {
+	return p.Serverless != nil
+}
+
+// CooldownPeriod returns how long to wait after adding or removing a replica before doing so again
+func (a Autoscaling) CooldownPeriod() time.Duration {
+	cooldown, err := time.ParseDuration(a.Cooldown)
+	if err != nil {
+		return defaultCooldown
+	}
+	return cooldown
+}
+
+func (a Autoscaling) validate() error {
+	if _, ok := Metrics[a.Metric]; !ok {
+		return errors.New("metric must be cpu, gremlin_requests or sparql_requests")
+	}
+	if a.Target <= 0 {
+		return errors.New("target must be greater than 0")
+	}
+	if a.MinReplicas < 0 || a.MaxReplicas < a.MinReplicas || a.MaxReplicas > MaxReplicas {
+		return errors.New("min_replicas and max_replicas must be between 0 and " + strconv.Itoa(MaxReplicas) + ", min_replicas first")
+	}
+	if a.Cooldown != "" {
+		if _, err := time.ParseDuration(a.Cooldown); err != nil {
+			return errors.New("cooldown must be a duration, e.g. 5m")
+		}
+	}
+	return nil
+}
+
+// Target returns how many unclaimed instances of the plan to keep, which can be
+// overridden with a PROVISION_<PLAN> environment variable (e.g. PROVISION_SMALL)
+func (p Plan) Target() int {
+	override := os.Getenv("PROVISION_" + strings.ToUpper(p.Name))
+	if override != "" {
+		if target, err := strconv.Atoi(override); err == nil {
+			return target
+		}
+	}
+	return p.PoolTarget
+}
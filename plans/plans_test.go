@@ -0,0 +1,52 @@
+package plans
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestValidCapacity(t *testing.T) {
+	tests := []struct {
+		min   float64
+		max   float64
+		valid bool
+	}{
+		{1, 128, true},
+		{1, 1, true},
+		{2.5, 16, true},
+		{0.5, 8, false},
+		{1, 128.5, false},
+		{8, 4, false},
+		{1.25, 8, false},
+		{1, 7.3, false},
+	}
+	for _, tt := range tests {
+		err := ValidCapacity(tt.min, tt.max)
+		if (err == nil) != tt.valid {
+			t.Errorf("ValidCapacity(%v, %v) = %v, expected valid to be %v", tt.min, tt.max, err, tt.valid)
+		}
+	}
+}
+
+func TestLoadMultiAZAutoscaling(t *testing.T) {
+	tests := []struct {
+		plan  string
+		valid bool
+	}{
+		{`{"small": {"instance_class": "db.r5.large", "multi_az": true, "autoscaling": {"min_replicas": 0, "max_replicas": 2, "metric": "cpu", "target": 50}}}`, true},
+		{`{"small": {"instance_class": "db.r5.large", "multi_az": true, "autoscaling": {"min_replicas": 0, "max_replicas": 0, "metric": "cpu", "target": 50}}}`, false},
+		{`{"small": {"instance_class": "db.r5.large", "autoscaling": {"min_replicas": 0, "max_replicas": 0, "metric": "cpu", "target": 50}}}`, true},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(t.TempDir(), "plans.json")
+		err := ioutil.WriteFile(path, []byte(tt.plan), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = Load(path)
+		if (err == nil) != tt.valid {
+			t.Errorf("Load(%s) = %v, expected valid to be %v", tt.plan, err, tt.valid)
+		}
+	}
+}
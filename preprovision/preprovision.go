@@ -2,17 +2,26 @@ package preprovision
 
 import (
 	"database/sql"
-	"encoding/json"
 	"errors"
 	"fmt"
+	"math/rand"
 	"os"
 	"strconv"
 	"strings"
 	"time"
 
+	autoscale "neptune-aws-api/autoscale"
+	cloud "neptune-aws-api/cloud"
+	credentials "neptune-aws-api/credentials"
+	lifecycle "neptune-aws-api/lifecycle"
+	plans "neptune-aws-api/plans"
+	replicas "neptune-aws-api/replicas"
+	rotation "neptune-aws-api/rotation"
+	secrets "neptune-aws-api/secrets"
+	teardown "neptune-aws-api/teardown"
+
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/iam"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/service/neptune"
 	_ "github.com/lib/pq"
 	uuid "github.com/nu7hatch/gouuid"
@@ -21,8 +30,11 @@ import (
 type neptuneParams struct {
 	DBInstanceClass      string
 	Engine               string
+	EngineVersion        string
+	ParameterGroup       string
 	DBInstanceIdentifier string
 	MultiAZ              bool
+	AvailabilityZones    []string
 	DBSubnetGroupName    string
 	StorageEncrypted     bool
 	KmsKeyID             string
@@ -30,33 +42,11 @@ type neptuneParams struct {
 	Endpoint             string
 	Accesskey            string
 	Secretkey            string
-}
-
-//NeptuneUser ..
-type NeptuneUser struct {
-	Username  string
-	Arn       string
-	Accesskey string
-	Secretkey string
-}
-
-//SimpleUserPolicy ...
-type SimpleUserPolicy struct {
-	PolicyName string
-	Arn        string
-}
-
-//UserPolicy ...
-type UserPolicy struct {
-	Statement []UserPolicyStatement `json:"Statement"`
-	Version   string                `json:"Version"`
-}
-
-//UserPolicyStatement ...
-type UserPolicyStatement struct {
-	Resource []string `json:"Resource"`
-	Action   []string `json:"Action"`
-	Effect   string   `json:"Effect"`
+	Billingcode          string
+	Source               string
+	DeletionProtection   bool
+	MinCapacity          float64
+	MaxCapacity          float64
 }
 
 var currentTime time.Time
@@ -64,22 +54,32 @@ var currentTime time.Time
 func Run() {
 
 	// initialize time (timezone, etc)
-	currentTime = time.Now().UTC()
-	location, err := time.LoadLocation("America/Denver")
-	if err == nil {
-		currentTime = currentTime.In(location)
-	} else {
-		fmt.Println(err.Error())
-	}
+	currentTime = localTime()
 
 	fmt.Println("Neptune Preprovisioner Started at " + currentTime.String())
 
-	small, _ := strconv.Atoi(os.Getenv("PROVISION_SMALL"))
-	if need("small", small) {
-		record(provision("small"), "small")
+	for _, name := range plans.Names() {
+		plan, _ := plans.Get(name)
+		if need(plan.Name, plan.Target()) {
+			err := provision(plan.Name)
+			if err != nil {
+				fmt.Println(err.Error())
+			}
+		}
 	}
 
 	insertEndpoints()
+	setupIAM()
+	reapDeleted()
+	finishDeletes()
+	keepStopped()
+	finishStarts()
+	finishTeardowns()
+	finishPlanChanges()
+	updateReplicas()
+	autoscaleReplicas()
+	updateSnapshots()
+	rotateKeys()
 
 	// Separate output
 	fmt.Println("")
@@ -96,7 +96,7 @@ func need(plan string, minimum int) bool {
 	defer db.Close()
 
 	var unclaimedcount int
-	err = db.QueryRow("SELECT count(*) as unclaimedcount from provision where plan='" + plan + "' and claimed='no'").Scan(&unclaimedcount)
+	err = db.QueryRow("SELECT count(*) as unclaimedcount from provision where plan=$1 and state in ($2, $3, $4) and source is null", plan, lifecycle.Creating, lifecycle.IAMPending, lifecycle.Available).Scan(&unclaimedcount)
 	if err != nil {
 		fmt.Println(err)
 		return false
@@ -109,40 +109,269 @@ func need(plan string, minimum int) bool {
 	return false
 }
 
-func provision(plan string) neptuneParams {
+// Record a new instance and request its cluster and instance from AWS, undoing whatever
+// was created if a later request fails
+func provision(planName string) error {
+	dbparams, err := newParams(planName)
+	if err != nil {
+		return err
+	}
+	dbparams.Billingcode = "preprovisioned"
+
+	svc := cloud.Neptune()
+
+	clusterParams := &neptune.CreateDBClusterInput{
+		Engine:                          aws.String(dbparams.Engine),
+		DBClusterIdentifier:             aws.String(dbparams.DBInstanceIdentifier),
+		DBSubnetGroupName:               aws.String(dbparams.DBSubnetGroupName),
+		StorageEncrypted:                aws.Bool(dbparams.StorageEncrypted),
+		EnableIAMDatabaseAuthentication: aws.Bool(true),
+		VpcSecurityGroupIds: []*string{
+			aws.String(dbparams.Securitygroupid),
+		},
+	}
+	clusterParams.ServerlessV2ScalingConfiguration = scalingConfiguration(dbparams)
+	if dbparams.EngineVersion != "" {
+		clusterParams.EngineVersion = aws.String(dbparams.EngineVersion)
+	}
+	if dbparams.ParameterGroup != "" {
+		clusterParams.DBClusterParameterGroupName = aws.String(dbparams.ParameterGroup)
+	}
+
+	return launch(dbparams, planName, nil, step{
+		Name: "create cluster",
+		Do: func() error {
+			resp, err := svc.CreateDBCluster(clusterParams)
+			if err == nil {
+				fmt.Println(resp)
+			}
+			return err
+		},
+		Undo: func() error { return deleteCluster(dbparams.DBInstanceIdentifier) },
+	})
+}
+
+// Restore records an instance claimed for billingcode and requests a cluster restored from a
+// snapshot, and its instance, from AWS. The preprovisioner finishes it like any other instance,
+// except that it becomes claimed rather than available once its IAM user is set up.
+func Restore(planName string, snapshot string, billingcode string, deletionProtection bool) (string, error) {
+	err := checkLaunchEnvironment()
+	if err != nil {
+		return "", err
+	}
+
+	dbparams, err := newParams(planName)
+	if err != nil {
+		return "", err
+	}
+	dbparams.Billingcode = billingcode
+	dbparams.Source = snapshot
+	dbparams.DeletionProtection = deletionProtection
+
+	tags := []*neptune.Tag{
+		{
+			Key:   aws.String("billingcode"),
+			Value: aws.String(billingcode),
+		},
+	}
+
+	svc := cloud.Neptune()
+
+	restoreParams := &neptune.RestoreDBClusterFromSnapshotInput{
+		Engine:                          aws.String(dbparams.Engine),
+		DBClusterIdentifier:             aws.String(dbparams.DBInstanceIdentifier),
+		SnapshotIdentifier:              aws.String(snapshot),
+		DBSubnetGroupName:               aws.String(dbparams.DBSubnetGroupName),
+		KmsKeyId:                        aws.String(dbparams.KmsKeyID),
+		EnableIAMDatabaseAuthentication: aws.Bool(true),
+		VpcSecurityGroupIds: []*string{
+			aws.String(dbparams.Securitygroupid),
+		},
+		Tags: tags,
+	}
+	restoreParams.ServerlessV2ScalingConfiguration = scalingConfiguration(dbparams)
+	if dbparams.EngineVersion != "" {
+		restoreParams.EngineVersion = aws.String(dbparams.EngineVersion)
+	}
+	if dbparams.ParameterGroup != "" {
+		restoreParams.DBClusterParameterGroupName = aws.String(dbparams.ParameterGroup)
+	}
+
+	err = launch(dbparams, planName, tags, step{
+		Name: "restore cluster",
+		Do: func() error {
+			resp, err := svc.RestoreDBClusterFromSnapshot(restoreParams)
+			if err == nil {
+				fmt.Println(resp)
+			}
+			return err
+		},
+		Undo: func() error { return deleteCluster(dbparams.DBInstanceIdentifier) },
+	})
+	return dbparams.DBInstanceIdentifier, err
+}
+
+// Clone records an instance claimed for billingcode and requests a copy of the cluster of
+// another instance, and its instance, from AWS. Without a restore time the copy is a
+// copy-on-write clone of the cluster as it is now, otherwise a full copy of the cluster as it
+// was at that time. Like restored instances, it becomes claimed once its IAM user is set up.
+func Clone(planName string, sourceName string, restoreTime *time.Time, billingcode string, deletionProtection bool) (string, error) {
+	err := checkLaunchEnvironment()
+	if err != nil {
+		return "", err
+	}
+
+	dbparams, err := newParams(planName)
+	if err != nil {
+		return "", err
+	}
+	dbparams.Billingcode = billingcode
+	dbparams.Source = sourceName
+	dbparams.DeletionProtection = deletionProtection
+
+	tags := []*neptune.Tag{
+		{
+			Key:   aws.String("billingcode"),
+			Value: aws.String(billingcode),
+		},
+	}
+
+	svc := cloud.Neptune()
+
+	cloneParams := &neptune.RestoreDBClusterToPointInTimeInput{
+		DBClusterIdentifier:             aws.String(dbparams.DBInstanceIdentifier),
+		SourceDBClusterIdentifier:       aws.String(sourceName),
+		DBSubnetGroupName:               aws.String(dbparams.DBSubnetGroupName),
+		KmsKeyId:                        aws.String(dbparams.KmsKeyID),
+		EnableIAMDatabaseAuthentication: aws.Bool(true),
+		VpcSecurityGroupIds: []*string{
+			aws.String(dbparams.Securitygroupid),
+		},
+		Tags: tags,
+	}
+	cloneParams.ServerlessV2ScalingConfiguration = scalingConfiguration(dbparams)
+	if restoreTime == nil {
+		cloneParams.RestoreType = aws.String("copy-on-write")
+		cloneParams.UseLatestRestorableTime = aws.Bool(true)
+	} else {
+		cloneParams.RestoreType = aws.String("full-copy")
+		cloneParams.RestoreToTime = aws.Time(*restoreTime)
+	}
+	if dbparams.ParameterGroup != "" {
+		cloneParams.DBClusterParameterGroupName = aws.String(dbparams.ParameterGroup)
+	}
+
+	err = launch(dbparams, planName, tags, step{
+		Name: "clone cluster",
+		Do: func() error {
+			resp, err := svc.RestoreDBClusterToPointInTime(cloneParams)
+			if err == nil {
+				fmt.Println(resp)
+			}
+			return err
+		},
+		Undo: func() error { return deleteCluster(dbparams.DBInstanceIdentifier) },
+	})
+	return dbparams.DBInstanceIdentifier, err
+}
+
+// Instances can also be launched outside the preprovisioner, which has already checked these
+func checkLaunchEnvironment() error {
+	for _, name := range []string{"NAME_PREFIX", "SECURITY_GROUP_ID", "SUBNET_GROUP_NAME", "KMS_KEY_ID"} {
+		if os.Getenv(name) == "" {
+			return errors.New("Missing " + name + " environment variable")
+		}
+	}
+	return nil
+}
+
+// Returns the parameters of a new instance of a plan, with a new name
+func newParams(planName string) (*neptuneParams, error) {
 	dbparams := new(neptuneParams)
 
-	if plan == "small" {
-		dbparams.DBInstanceClass = "db.r4.large"
+	plan, err := plans.Get(planName)
+	if err != nil {
+		return nil, errors.New(err.Error() + ": " + planName)
 	}
 
+	dbparams.DBInstanceClass = plan.InstanceClass
+	dbparams.EngineVersion = plan.EngineVersion
+	dbparams.ParameterGroup = plan.ParameterGroup
 	dbparams.Engine = "neptune"
+	if plan.Serverless != nil {
+		dbparams.MinCapacity = plan.Serverless.MinCapacity
+		dbparams.MaxCapacity = plan.Serverless.MaxCapacity
+	}
 
 	// DBInstanceIdentifier (uuid + prefix)
 	neptuneuuid, _ := uuid.NewV4()
 	dbparams.DBInstanceIdentifier = os.Getenv("NAME_PREFIX") + strings.Split(neptuneuuid.String(), "-")[0]
 	fmt.Println(dbparams.DBInstanceIdentifier)
 
-	dbparams.MultiAZ = false
+	dbparams.MultiAZ = plan.MultiAZ
 	dbparams.DBSubnetGroupName = os.Getenv("SUBNET_GROUP_NAME")
+	if dbparams.MultiAZ {
+		dbparams.AvailabilityZones, err = availabilityZones(dbparams.DBSubnetGroupName)
+		if err != nil {
+			return nil, err
+		}
+	}
 	dbparams.StorageEncrypted = true
 	dbparams.KmsKeyID = os.Getenv("KMS_KEY_ID")
 	dbparams.Securitygroupid = os.Getenv("SECURITY_GROUP_ID")
 
-	svc := neptune.New(session.New(&aws.Config{
-		Region: aws.String(os.Getenv("REGION")),
-	}))
+	return dbparams, nil
+}
 
-	clusterParams := &neptune.CreateDBClusterInput{
-		Engine:                          aws.String(dbparams.Engine),
-		DBClusterIdentifier:             aws.String(dbparams.DBInstanceIdentifier),
-		DBSubnetGroupName:               aws.String(dbparams.DBSubnetGroupName),
-		StorageEncrypted:                aws.Bool(dbparams.StorageEncrypted),
-		EnableIAMDatabaseAuthentication: aws.Bool(true),
-		VpcSecurityGroupIds: []*string{
-			aws.String(dbparams.Securitygroupid),
-		},
+// Returns the serverless scaling configuration of the cluster of a serverless plan, nil otherwise
+func scalingConfiguration(dbparams *neptuneParams) *neptune.ServerlessV2ScalingConfiguration {
+	if dbparams.MaxCapacity == 0 {
+		return nil
+	}
+	return &neptune.ServerlessV2ScalingConfiguration{
+		MinCapacity: aws.Float64(dbparams.MinCapacity),
+		MaxCapacity: aws.Float64(dbparams.MaxCapacity),
 	}
+}
+
+// Returns the distinct availability zones of the subnets of a subnet group, in a random order.
+// Multi-AZ instances put their writer in the first and their reader in the second, so that the
+// writers of the pool are spread across every zone rather than all failing over together.
+func availabilityZones(subnetGroup string) ([]string, error) {
+	resp, err := cloud.Neptune().DescribeDBSubnetGroups(&neptune.DescribeDBSubnetGroupsInput{
+		DBSubnetGroupName: aws.String(subnetGroup),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var zones []string
+	seen := make(map[string]bool)
+	for _, group := range resp.DBSubnetGroups {
+		for _, subnet := range group.Subnets {
+			if subnet.SubnetAvailabilityZone == nil {
+				continue
+			}
+			zone := aws.StringValue(subnet.SubnetAvailabilityZone.Name)
+			if zone != "" && !seen[zone] {
+				seen[zone] = true
+				zones = append(zones, zone)
+			}
+		}
+	}
+	if len(zones) < 2 {
+		return nil, errors.New("Subnet group " + subnetGroup + " must span at least two availability zones for multi-AZ plans")
+	}
+	shuffle := rand.New(rand.NewSource(time.Now().UnixNano()))
+	shuffle.Shuffle(len(zones), func(i, j int) { zones[i], zones[j] = zones[j], zones[i] })
+	return zones, nil
+}
+
+// Record a new instance, then run the step that creates its cluster followed by the creation
+// of its instance and, for multi-AZ plans, of a reader in another availability zone. If any
+// fails, whatever was created is undone and the instance is failed.
+func launch(dbparams *neptuneParams, planName string, tags []*neptune.Tag, cluster step) error {
+	svc := cloud.Neptune()
 
 	instanceParams := &neptune.CreateDBInstanceInput{
 		DBInstanceClass:      aws.String(dbparams.DBInstanceClass),
@@ -150,42 +379,88 @@ func provision(plan string) neptuneParams {
 		Engine:               aws.String(dbparams.Engine),
 		DBClusterIdentifier:  aws.String(dbparams.DBInstanceIdentifier),
 		DBSubnetGroupName:    aws.String(dbparams.DBSubnetGroupName),
-		Tags: []*neptune.Tag{
+		Tags: append([]*neptune.Tag{
 			{
 				Key:   aws.String("Name"),
 				Value: aws.String(dbparams.DBInstanceIdentifier),
 			},
-		},
+		}, tags...),
 		StorageEncrypted: aws.Bool(dbparams.StorageEncrypted),
 	}
 
-	resp, err := svc.CreateDBCluster(clusterParams)
+	reader := step{Name: "create reader"}
+	if dbparams.MultiAZ {
+		instanceParams.AvailabilityZone = aws.String(dbparams.AvailabilityZones[0])
+	}
+
+	uri := os.Getenv("BROKER_DB")
+	db, err := sql.Open("postgres", uri)
 	if err != nil {
-		fmt.Println(err.Error())
-		os.Exit(2)
+		return err
 	}
-	fmt.Println(resp)
+	defer db.Close()
 
-	resp2, err2 := svc.CreateDBInstance(instanceParams)
-	if err2 != nil {
-		fmt.Println(err2.Error())
-		os.Exit(2)
+	if dbparams.MultiAZ {
+		var readerID string
+		reader.Do = func() error {
+			var err error
+			readerID, _, err = replicas.Create(db, dbparams.DBInstanceIdentifier, dbparams.DBInstanceClass, dbparams.AvailabilityZones[1])
+			return err
+		}
+		reader.Undo = func() error {
+			_, err := replicas.Delete(db, readerID)
+			return err
+		}
 	}
-	fmt.Println(resp2)
 
-	// Setup IAM Authentication
-	neptuneUser := createUser(*instanceParams.DBInstanceIdentifier)
-	simpleuserpolicy := createUserPolicy(*instanceParams.DBInstanceIdentifier, *resp.DBCluster.DbClusterResourceId)
-	attachUserPolicy(*instanceParams.DBInstanceIdentifier, simpleuserpolicy)
+	err = record(db, *dbparams, planName)
+	if err != nil {
+		return err
+	}
 
-	dbparams.Accesskey = neptuneUser.Accesskey
-	dbparams.Secretkey = neptuneUser.Secretkey
+	err = runSteps(db, dbparams.DBInstanceIdentifier, []step{
+		cluster,
+		{
+			Name: "create instance",
+			Do: func() error {
+				resp, err := svc.CreateDBInstance(instanceParams)
+				if err == nil {
+					fmt.Println(resp)
+				}
+				return err
+			},
+			Undo: func() error { return deleteInstance(dbparams.DBInstanceIdentifier) },
+		},
+		reader,
+	})
+	if err != nil {
+		terr := lifecycle.Transition(db, dbparams.DBInstanceIdentifier, lifecycle.Creating, lifecycle.Failed)
+		if terr != nil {
+			fmt.Println(terr)
+		}
+		return err
+	}
 
-	return *dbparams
+	return nil
 }
 
-func record(dbparams neptuneParams, plan string) {
+func record(db *sql.DB, dbparams neptuneParams, plan string) error {
+	var newname string
+	err := db.QueryRow("INSERT INTO provision(name,plan,state,makeDate,billingcode,endpoint, accesskey, secretkey, source, deletionprotection) VALUES($1,$2,$3,$4,$5,$6,$7,$8,NULLIF($9,''),$10) returning name;", dbparams.DBInstanceIdentifier, plan, lifecycle.Creating, localTime().Format("2006-01-02 15:04:05"), dbparams.Billingcode, dbparams.Endpoint, dbparams.Accesskey, dbparams.Secretkey, dbparams.Source, dbparams.DeletionProtection).Scan(&newname)
 
+	if err != nil {
+		return err
+	}
+	err = lifecycle.Record(db, newname, lifecycle.Creating)
+	if err != nil {
+		fmt.Println(err)
+	}
+	fmt.Println(newname)
+	return nil
+}
+
+// Record the endpoint of every instance that has finished creating and move it on to IAM setup
+func insertEndpoints() {
 	uri := os.Getenv("BROKER_DB")
 	db, err := sql.Open("postgres", uri)
 	if err != nil {
@@ -194,17 +469,56 @@ func record(dbparams neptuneParams, plan string) {
 	}
 	defer db.Close()
 
-	var newname string
-	err = db.QueryRow("INSERT INTO provision(name,plan,claimed,makeDate,billingcode,endpoint, accesskey, secretkey) VALUES($1,$2,$3,$4,$5,$6,$7,$8) returning name;", dbparams.DBInstanceIdentifier, plan, "no", currentTime.Format("2006-01-02 15:04:05"), "preprovisioned", dbparams.Endpoint, dbparams.Accesskey, dbparams.Secretkey).Scan(&newname)
-
+	names, err := namesInState(db, lifecycle.Creating)
 	if err != nil {
 		fmt.Println(err)
 		return
 	}
-	fmt.Println(newname)
+
+	fmt.Println("Looking for endpoints...")
+
+	for _, name := range names {
+		fmt.Println("Attempting add endpoint for " + name + "...")
+		status, serr := getStatus(name)
+		if serr != nil {
+			fmt.Println(serr)
+			continue
+		}
+
+		if isFailedStatus(status) {
+			fmt.Println(name + " failed to provision with status " + status)
+			err = lifecycle.Transition(db, name, lifecycle.Creating, lifecycle.Failed)
+			if err != nil {
+				fmt.Println(err)
+			}
+			continue
+		}
+
+		if status == "available" {
+			var endpoint string
+			var eerr error
+			if multiAZ(db, name) {
+				// The instance itself becomes a reader when the cluster fails over, so hand
+				// out the cluster endpoint, which follows the writer
+				endpoint, eerr = getClusterEndpoint(name)
+			} else {
+				endpoint, eerr = getEndpoint(name)
+			}
+			if eerr != nil {
+				fmt.Println(eerr)
+				continue
+			}
+			addEndpoint(name, endpoint)
+			err = lifecycle.Transition(db, name, lifecycle.Creating, lifecycle.IAMPending)
+			if err != nil {
+				fmt.Println(err)
+			}
+		}
+	}
 }
 
-func insertEndpoints() {
+// Create the IAM user, access key and policy of every instance waiting for them and make it available
+func setupIAM() {
 	uri := os.Getenv("BROKER_DB")
 	db, err := sql.Open("postgres", uri)
 	if err != nil {
@@ -213,35 +527,202 @@ func insertEndpoints() {
 	}
 	defer db.Close()
 
-	rows, err := db.Query("select name from provision where endpoint=''")
+	names, err := namesInState(db, lifecycle.IAMPending)
 	if err != nil {
 		fmt.Println(err)
 		return
 	}
 
-	fmt.Println("Looking for endpoints...")
+	for _, name := range names {
+		// Instances provisioned before IAM setup was deferred already have credentials
+		var accesskey, source string
+		var protected bool
+		err = db.QueryRow("SELECT coalesce(accesskey, ''), coalesce(source, ''), deletionprotection FROM provision WHERE name=$1", name).Scan(&accesskey, &source, &protected)
+		if err != nil {
+			fmt.Println(err)
+			continue
+		}
+
+		if accesskey == "" {
+			fmt.Println("Setting up IAM authentication for " + name + "...")
+			err = runSteps(db, name, iamSteps(db, name))
+			if err != nil {
+				fmt.Println(err)
+				err = lifecycle.Transition(db, name, lifecycle.IAMPending, lifecycle.Failed)
+				if err != nil {
+					fmt.Println(err)
+					continue
+				}
+				// A pool instance was never handed out, so its cluster, replicas included,
+				// is deleted now. Restored and cloned instances belong to a caller and are
+				// kept failed until they are deleted.
+				if source == "" {
+					teardown.Instance(db, name, lifecycle.Failed, "")
+				}
+				continue
+			}
+		}
+
+		// Protection is only applied now so that a failed launch can still be undone
+		if protected {
+			_, err = cloud.Neptune().ModifyDBCluster(&neptune.ModifyDBClusterInput{
+				DBClusterIdentifier: aws.String(name),
+				DeletionProtection:  aws.Bool(true),
+				ApplyImmediately:    aws.Bool(true),
+			})
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+		}
 
+		// Instances restored for a caller were claimed when they were requested
+		next := lifecycle.Available
+		if source != "" {
+			next = lifecycle.Claimed
+		}
+		err = lifecycle.Transition(db, name, lifecycle.IAMPending, next)
+		if err != nil {
+			fmt.Println(err)
+		}
+	}
+}
+
+// Returns the steps that give an instance its own IAM user, access key and policy. A failure
+// only undoes these, the cluster is left to teardown.
+func iamSteps(db *sql.DB, name string) []step {
+	var user credentials.NeptuneUser
+	var policy credentials.SimpleUserPolicy
+
+	return []step{
+		{
+			Name: "create user",
+			Do: func() (err error) {
+				user, err = credentials.CreateUser(name)
+				return err
+			},
+			Undo: func() error { return credentials.DeleteUser(name) },
+		},
+		{
+			Name: "create access key",
+			Do: func() (err error) {
+				user.Accesskey, user.Secretkey, err = credentials.CreateAccessKey(name)
+				return err
+			},
+			Undo: func() error { return credentials.DeleteAccessKey(name, user.Accesskey) },
+		},
+		{
+			Name: "create policy",
+			Do: func() error {
+				resourceID, err := getClusterResourceID(name)
+				if err != nil {
+					return err
+				}
+				policy, err = credentials.CreateUserPolicy(name, resourceID)
+				return err
+			},
+			Undo: func() error { return credentials.DeletePolicy(policy.Arn) },
+		},
+		{
+			Name: "attach policy",
+			Do:   func() error { return credentials.AttachUserPolicy(name, policy) },
+			Undo: func() error { return credentials.DetachUserPolicy(name, policy.Arn) },
+		},
+		{
+			Name: "store credentials",
+			Do: func() error {
+				accesskey, err := secrets.Encrypt(user.Accesskey)
+				if err != nil {
+					return err
+				}
+				secretkey, err := secrets.Encrypt(user.Secretkey)
+				if err != nil {
+					return err
+				}
+				_, err = db.Exec("UPDATE provision SET accesskey=$1, secretkey=$2, keycreated=now() WHERE name=$3", accesskey, secretkey, name)
+				return err
+			},
+		},
+	}
+}
+
+// Delete soft deleted instances whose retention period has passed, along with their IAM users
+// and bindings, taking the final snapshot that was asked for when they were soft deleted
+func reapDeleted() {
+	uri := os.Getenv("BROKER_DB")
+	db, err := sql.Open("postgres", uri)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(2)
+	}
+	defer db.Close()
+
+	rows, err := db.Query("SELECT name, coalesce(finalsnapshot, '') FROM provision WHERE state=$1 AND deleteafter <= now() ORDER BY deleteafter", lifecycle.PendingDeletion)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	expired := make(map[string]string)
+	var names []string
 	for rows.Next() {
-		var name string
-		err = rows.Scan(&name)
+		var name, snapshot string
+		err = rows.Scan(&name, &snapshot)
 		if err != nil {
 			fmt.Println(err)
+			rows.Close()
 			return
 		}
+		expired[name] = snapshot
+		names = append(names, name)
+	}
+	rows.Close()
 
-		fmt.Println("Attempting add endpoint for " + name + "...")
-		if isAvailable(name) {
-			endpoint, eerr := getEndpoint(name)
-			if eerr != nil {
+	for _, name := range names {
+		fmt.Println("Retention period of " + name + " has ended, deleting...")
+		err = teardown.Instance(db, name, lifecycle.PendingDeletion, expired[name])
+		if err != nil {
+			continue
+		}
+		teardown.IAM(db, name)
+	}
+}
+
+// Mark instances as deleted once their cluster no longer exists in AWS
+func finishDeletes() {
+	uri := os.Getenv("BROKER_DB")
+	db, err := sql.Open("postgres", uri)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(2)
+	}
+	defer db.Close()
+
+	names, err := namesInState(db, lifecycle.Deleting)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	svc := cloud.Neptune()
+	for _, name := range names {
+		_, derr := svc.DescribeDBClusters(&neptune.DescribeDBClustersInput{
+			DBClusterIdentifier: aws.String(name),
+		})
+		if aerr, ok := derr.(awserr.Error); ok && aerr.Code() == neptune.ErrCodeDBClusterNotFoundFault {
+			fmt.Println(name + " has been deleted")
+			err = lifecycle.Transition(db, name, lifecycle.Deleting, lifecycle.Deleted)
+			if err != nil {
 				fmt.Println(err)
-				return
 			}
-			addEndpoint(name, endpoint)
+		} else if derr != nil {
+			fmt.Println(derr)
 		}
 	}
 }
 
-func addEndpoint(name string, endpoint string) {
+// Stop the clusters of stopped and soft deleted instances again once AWS has started them, which
+// it does after a cluster has been stopped for seven days
+func keepStopped() {
 	uri := os.Getenv("BROKER_DB")
 	db, err := sql.Open("postgres", uri)
 	if err != nil {
@@ -250,155 +731,529 @@ func addEndpoint(name string, endpoint string) {
 	}
 	defer db.Close()
 
-	_, err = db.Exec("UPDATE provision SET endpoint=$1 WHERE name=$2", endpoint, name)
+	var names []string
+	for _, state := range []string{lifecycle.Stopped, lifecycle.PendingDeletion} {
+		inState, err := namesInState(db, state)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		names = append(names, inState...)
+	}
+
+	svc := cloud.Neptune()
+	for _, name := range names {
+		resp, derr := svc.DescribeDBClusters(&neptune.DescribeDBClustersInput{
+			DBClusterIdentifier: aws.String(name),
+		})
+		if derr != nil {
+			fmt.Println(derr)
+			continue
+		}
+		// A cluster that is still starting can't be stopped yet, it is picked up on a later run
+		if aws.StringValue(resp.DBClusters[0].Status) != "available" {
+			continue
+		}
+
+		fmt.Println(name + " was started by AWS, stopping it again...")
+		_, serr := svc.StopDBCluster(&neptune.StopDBClusterInput{
+			DBClusterIdentifier: aws.String(name),
+		})
+		if serr != nil {
+			fmt.Println(serr)
+		}
+	}
+}
+
+// Move instances whose cluster was started back to claimed once it and their instance are
+// available again
+func finishStarts() {
+	uri := os.Getenv("BROKER_DB")
+	db, err := sql.Open("postgres", uri)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(2)
+	}
+	defer db.Close()
+
+	names, err := namesInState(db, lifecycle.Starting)
 	if err != nil {
 		fmt.Println(err)
 		return
 	}
+
+	svc := cloud.Neptune()
+	for _, name := range names {
+		resp, derr := svc.DescribeDBClusters(&neptune.DescribeDBClustersInput{
+			DBClusterIdentifier: aws.String(name),
+		})
+		if derr != nil {
+			fmt.Println(derr)
+			continue
+		}
+		if aws.StringValue(resp.DBClusters[0].Status) != "available" {
+			continue
+		}
+		status, serr := getStatus(name)
+		if serr != nil {
+			fmt.Println(serr)
+			continue
+		}
+		if status != "available" {
+			continue
+		}
+
+		fmt.Println(name + " has started")
+		err = lifecycle.Transition(db, name, lifecycle.Starting, lifecycle.Claimed)
+		if err != nil {
+			fmt.Println(err)
+		}
+	}
 }
 
-func getEndpoint(name string) (endpoint string, err error) {
-	region := os.Getenv("REGION")
-	svc := neptune.New(session.New(&aws.Config{
-		Region: aws.String(region),
-	}))
-	params := &neptune.DescribeDBInstancesInput{
-		DBInstanceIdentifier: aws.String(name),
-		MaxRecords:           aws.Int64(20),
+// Retry the IAM teardown jobs of deleted instances and bindings that are due
+func finishTeardowns() {
+	uri := os.Getenv("BROKER_DB")
+	db, err := sql.Open("postgres", uri)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(2)
 	}
-	resp, err := svc.DescribeDBInstances(params)
+	defer db.Close()
+
+	teardown.RunJobs(db)
+}
+
+type planChange struct {
+	id            int
+	name          string
+	plan          string
+	instanceclass string
+	immediately   bool
+}
+
+// Finish the plan changes whose new instance class has been applied to the instance and its
+// replicas, updating the plan of the instance and its billing tags. Changes of instances that no longer exist are failed.
+func finishPlanChanges() {
+	uri := os.Getenv("BROKER_DB")
+	db, err := sql.Open("postgres", uri)
 	if err != nil {
 		fmt.Println(err)
-		err = errors.New("Failed to get instance information for " + name)
-		return endpoint, err
+		os.Exit(2)
 	}
+	defer db.Close()
 
-	endpoint = *resp.DBInstances[0].Endpoint.Address + ":" + strconv.FormatInt(*resp.DBInstances[0].Endpoint.Port, 10)
-	return endpoint, nil
+	rows, err := db.Query("SELECT id, name, newplan, instanceclass, applyimmediately FROM plan_changes WHERE status='pending' ORDER BY id")
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	var changes []planChange
+	for rows.Next() {
+		var c planChange
+		err = rows.Scan(&c.id, &c.name, &c.plan, &c.instanceclass, &c.immediately)
+		if err != nil {
+			fmt.Println(err)
+			rows.Close()
+			return
+		}
+		changes = append(changes, c)
+	}
+	rows.Close()
+
+	svc := cloud.Neptune()
+	for _, c := range changes {
+		resp, derr := svc.DescribeDBInstances(&neptune.DescribeDBInstancesInput{
+			DBInstanceIdentifier: aws.String(c.name),
+		})
+		if aerr, ok := derr.(awserr.Error); ok && aerr.Code() == neptune.ErrCodeDBInstanceNotFoundFault {
+			_, err = db.Exec("UPDATE plan_changes SET status='failed', error=$1, finished=now() WHERE id=$2", "Instance no longer exists", c.id)
+			if err != nil {
+				fmt.Println(err)
+			}
+			continue
+		} else if derr != nil {
+			fmt.Println(derr)
+			continue
+		}
+
+		instance := resp.DBInstances[0]
+		applied := aws.StringValue(instance.DBInstanceClass) == c.instanceclass && aws.StringValue(instance.DBInstanceStatus) == "available" &&
+			(instance.PendingModifiedValues == nil || instance.PendingModifiedValues.DBInstanceClass == nil)
+		if !applied {
+			continue
+		}
+		// Replicas follow the writer so that a failover doesn't change the size of the writer
+		resized, rerr := replicas.Resize(db, c.name, c.instanceclass, c.immediately)
+		if rerr != nil {
+			fmt.Println(rerr)
+			continue
+		}
+		if !resized {
+			continue
+		}
+
+		err = finishPlanChange(db, c)
+		if err != nil {
+			fmt.Println(err)
+			continue
+		}
+		fmt.Println(c.name + " is now on plan " + c.plan)
+
+		err = tagPlan(db, c.name, c.plan)
+		if err != nil {
+			fmt.Println(err)
+		}
+	}
 }
 
-func isAvailable(name string) bool {
-	region := os.Getenv("REGION")
+func finishPlanChange(db *sql.DB, c planChange) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
 
-	svc := neptune.New(session.New(&aws.Config{
-		Region: aws.String(region),
-	}))
+	_, err = tx.Exec("UPDATE provision SET plan=$1 WHERE name=$2", c.plan, c.name)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("UPDATE plan_changes SET status='done', error=NULL, finished=now() WHERE id=$1", c.id)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
 
-	rparams := &neptune.DescribeDBInstancesInput{
-		DBInstanceIdentifier: aws.String(name),
-		MaxRecords:           aws.Int64(20),
+// Tag the cluster, instance and replicas of an instance with its plan and billingcode
+func tagPlan(db *sql.DB, name string, plan string) error {
+	var billingcode string
+	err := db.QueryRow("SELECT coalesce(billingcode, '') FROM provision WHERE name=$1", name).Scan(&billingcode)
+	if err != nil {
+		return err
 	}
-	rresp, rerr := svc.DescribeDBInstances(rparams)
-	if rerr != nil {
-		fmt.Println(rerr)
-		return false
+	ids, err := replicas.IDs(db, name)
+	if err != nil {
+		return err
 	}
-	fmt.Println("Checking to see if available...")
-	fmt.Println(name + " Status: " + *rresp.DBInstances[0].DBInstanceStatus)
-	status := *rresp.DBInstances[0].DBInstanceStatus
-	if status == "available" {
-		return true
+
+	tags := []*neptune.Tag{
+		{
+			Key:   aws.String("plan"),
+			Value: aws.String(plan),
+		},
 	}
-	return false
+	if billingcode != "" {
+		tags = append(tags, &neptune.Tag{
+			Key:   aws.String("billingcode"),
+			Value: aws.String(billingcode),
+		})
+	}
+
+	region := os.Getenv("REGION")
+	accountnumber := os.Getenv("ACCOUNTNUMBER")
+	svc := cloud.Neptune()
+	arns := []string{
+		"arn:aws:rds:" + region + ":" + accountnumber + ":cluster:" + name,
+		"arn:aws:rds:" + region + ":" + accountnumber + ":db:" + name,
+	}
+	for _, id := range ids {
+		arns = append(arns, "arn:aws:rds:"+region+":"+accountnumber+":db:"+id)
+	}
+	for _, arn := range arns {
+		_, err = svc.AddTagsToResource(&neptune.AddTagsToResourceInput{
+			ResourceName: aws.String(arn),
+			Tags:         tags,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-// IAM Helper Functions
-func createUser(username string) NeptuneUser {
+// Record the AWS status of every read replica, marking it deleted once it no longer exists
+func updateReplicas() {
+	uri := os.Getenv("BROKER_DB")
+	db, err := sql.Open("postgres", uri)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(2)
+	}
+	defer db.Close()
+
+	rows, err := db.Query("SELECT id, status FROM replicas WHERE status NOT IN ('deleted', 'failed') ORDER BY created")
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	current := make(map[string]string)
+	var ids []string
+	for rows.Next() {
+		var id, status string
+		err = rows.Scan(&id, &status)
+		if err != nil {
+			fmt.Println(err)
+			rows.Close()
+			return
+		}
+		current[id] = status
+		ids = append(ids, id)
+	}
+	rows.Close()
+
+	for _, id := range ids {
+		status, serr := getStatus(id)
+		if aerr, ok := serr.(awserr.Error); ok && aerr.Code() == neptune.ErrCodeDBInstanceNotFoundFault {
+			status = "deleted"
+			if current[id] != "deleting" {
+				status = "failed"
+			}
+		} else if serr != nil {
+			fmt.Println(serr)
+			continue
+		}
 
-	svc := iam.New(session.New(&aws.Config{
-		Region: aws.String(os.Getenv("REGION")),
-	}))
+		if status != current[id] {
+			fmt.Println("Replica " + id + " is " + status)
+			_, err = db.Exec("UPDATE replicas SET status=$1 WHERE id=$2", status, id)
+			if err != nil {
+				fmt.Println(err)
+			}
+		}
+	}
+}
 
-	params := &iam.CreateUserInput{
-		UserName: aws.String(username),
+// Add or remove read replicas of claimed instances whose plan autoscales
+func autoscaleReplicas() {
+	uri := os.Getenv("BROKER_DB")
+	db, err := sql.Open("postgres", uri)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(2)
 	}
-	resp, err := svc.CreateUser(params)
+	defer db.Close()
 
+	autoscale.Run(db)
+}
+
+// Record the status of every snapshot that is being created or deleted, marking it deleted once
+// it no longer exists. Final snapshots are pending until they appear, or failed if the cluster
+// is gone without them.
+func updateSnapshots() {
+	uri := os.Getenv("BROKER_DB")
+	db, err := sql.Open("postgres", uri)
 	if err != nil {
-		fmt.Println(err.Error())
+		fmt.Println(err)
+		os.Exit(2)
+	}
+	defer db.Close()
 
+	rows, err := db.Query("SELECT s.id, s.status, p.state FROM snapshots s JOIN provision p ON p.name = s.name WHERE s.status in ('pending', 'creating', 'deleting') ORDER BY s.created")
+	if err != nil {
+		fmt.Println(err)
+		return
 	}
+	pending := make(map[string]string)
+	states := make(map[string]string)
+	var ids []string
+	for rows.Next() {
+		var id, status, state string
+		err = rows.Scan(&id, &status, &state)
+		if err != nil {
+			fmt.Println(err)
+			rows.Close()
+			return
+		}
+		pending[id] = status
+		states[id] = state
+		ids = append(ids, id)
+	}
+	rows.Close()
+
+	svc := cloud.Neptune()
+	for _, id := range ids {
+		resp, derr := svc.DescribeDBClusterSnapshots(&neptune.DescribeDBClusterSnapshotsInput{
+			DBClusterSnapshotIdentifier: aws.String(id),
+		})
+		var status string
+		if aerr, ok := derr.(awserr.Error); ok && aerr.Code() == neptune.ErrCodeDBClusterSnapshotNotFoundFault {
+			status = "deleted"
+			if pending[id] == "pending" && states[id] != lifecycle.Deleted && states[id] != lifecycle.Failed {
+				continue
+			} else if pending[id] != "deleting" {
+				status = "failed"
+			}
+		} else if derr != nil {
+			fmt.Println(derr)
+			continue
+		} else {
+			status = *resp.DBClusterSnapshots[0].Status
+		}
 
-	arn := *resp.User.Arn
+		if status != pending[id] {
+			fmt.Println("Snapshot " + id + " is " + status)
+			_, err = db.Exec("UPDATE snapshots SET status=$1 WHERE id=$2", status, id)
+			if err != nil {
+				fmt.Println(err)
+			}
+		}
+	}
+}
 
-	paramskey := &iam.CreateAccessKeyInput{
-		UserName: aws.String(username),
+// Delete the old access keys of finished rotations and rotate access keys past their maximum age
+func rotateKeys() {
+	uri := os.Getenv("BROKER_DB")
+	db, err := sql.Open("postgres", uri)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(2)
 	}
-	respkey, err := svc.CreateAccessKey(paramskey)
+	defer db.Close()
+
+	rotation.Run(db)
+}
 
+// Returns the current time in the timezone makedate is recorded in
+func localTime() time.Time {
+	t := time.Now().UTC()
+	location, err := time.LoadLocation("America/Denver")
 	if err != nil {
 		fmt.Println(err.Error())
+		return t
 	}
+	return t.In(location)
+}
 
-	accesskey := *respkey.AccessKey.AccessKeyId
-	secretkey := *respkey.AccessKey.SecretAccessKey
-	var neptuneuser NeptuneUser
-	neptuneuser.Username = username
-	neptuneuser.Arn = arn
-	neptuneuser.Accesskey = accesskey
-	neptuneuser.Secretkey = secretkey
-	return neptuneuser
+// Returns the names of every instance in a lifecycle state, oldest first
+func namesInState(db *sql.DB, state string) ([]string, error) {
+	rows, err := db.Query("SELECT name FROM provision WHERE state=$1 ORDER BY makedate", state)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
 
+	var names []string
+	for rows.Next() {
+		var name string
+		err = rows.Scan(&name)
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	return names, rows.Err()
 }
 
-func createUserPolicy(username string, resourceID string) SimpleUserPolicy {
-
-	var userpolicy UserPolicy
-	userpolicy.Version = "2012-10-17"
-	var statements []UserPolicyStatement
-	var statement UserPolicyStatement
-	statement.Effect = "Allow"
-	var resources []string
-	resources = append(resources, "arn:aws:neptune-db:"+os.Getenv("REGION")+":"+os.Getenv("ACCOUNTNUMBER")+":"+resourceID+"/*")
-	resources = append(resources, "arn:aws:neptune-db:"+os.Getenv("REGION")+":"+os.Getenv("ACCOUNTNUMBER")+":"+resourceID)
-	statement.Resource = resources
-	var actions []string
-	actions = append(actions, "neptune-db:*")
-	statement.Action = actions
-	statements = append(statements, statement)
-	userpolicy.Statement = statements
-	str, err := json.Marshal(userpolicy)
+func addEndpoint(name string, endpoint string) {
+	uri := os.Getenv("BROKER_DB")
+	db, err := sql.Open("postgres", uri)
 	if err != nil {
-		fmt.Println("Error preparing request")
+		fmt.Println(err)
+		os.Exit(2)
 	}
-	jsonStr := (string(str))
+	defer db.Close()
 
-	svc := iam.New(session.New(&aws.Config{
-		Region: aws.String(os.Getenv("REGION")),
-	}))
+	_, err = db.Exec("UPDATE provision SET endpoint=$1 WHERE name=$2", endpoint, name)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+}
 
-	params := &iam.CreatePolicyInput{
-		PolicyDocument: aws.String(jsonStr),
-		PolicyName:     aws.String(username + "policy"),
+func getEndpoint(name string) (endpoint string, err error) {
+	svc := cloud.Neptune()
+	params := &neptune.DescribeDBInstancesInput{
+		DBInstanceIdentifier: aws.String(name),
+		MaxRecords:           aws.Int64(20),
+	}
+	resp, err := svc.DescribeDBInstances(params)
+	if err != nil {
+		fmt.Println(err)
+		err = errors.New("Failed to get instance information for " + name)
+		return endpoint, err
 	}
-	resp, err := svc.CreatePolicy(params)
 
+	endpoint = *resp.DBInstances[0].Endpoint.Address + ":" + strconv.FormatInt(*resp.DBInstances[0].Endpoint.Port, 10)
+	return endpoint, nil
+}
+
+// Returns the writer endpoint of the cluster of an instance
+func getClusterEndpoint(name string) (string, error) {
+	resp, err := cloud.Neptune().DescribeDBClusters(&neptune.DescribeDBClustersInput{
+		DBClusterIdentifier: aws.String(name),
+	})
 	if err != nil {
-		fmt.Println(err.Error())
+		fmt.Println(err)
+		return "", errors.New("Failed to get cluster information for " + name)
 	}
+	return *resp.DBClusters[0].Endpoint + ":" + strconv.FormatInt(*resp.DBClusters[0].Port, 10), nil
+}
 
-	policyarn := *resp.Policy.Arn
-	policyname := *resp.Policy.PolicyName
-	var simpleuserpolicy SimpleUserPolicy
-	simpleuserpolicy.PolicyName = policyname
-	simpleuserpolicy.Arn = policyarn
-	return simpleuserpolicy
+// Returns whether an instance is on a multi-AZ plan
+func multiAZ(db *sql.DB, name string) bool {
+	var planName string
+	err := db.QueryRow("SELECT plan FROM provision WHERE name=$1", name).Scan(&planName)
+	if err != nil {
+		fmt.Println(err)
+		return false
+	}
+	plan, err := plans.Get(planName)
+	return err == nil && plan.MultiAZ
 }
 
-func attachUserPolicy(username string, simpleuserpolicy SimpleUserPolicy) {
-	svc := iam.New(session.New(&aws.Config{
-		Region: aws.String(os.Getenv("REGION")),
-	}))
+// Returns the AWS status of an instance
+func getStatus(name string) (string, error) {
+	svc := cloud.Neptune()
 
-	params := &iam.AttachUserPolicyInput{
-		PolicyArn: aws.String(simpleuserpolicy.Arn),
-		UserName:  aws.String(username),
+	rparams := &neptune.DescribeDBInstancesInput{
+		DBInstanceIdentifier: aws.String(name),
+		MaxRecords:           aws.Int64(20),
 	}
-	_, err := svc.AttachUserPolicy(params)
+	rresp, rerr := svc.DescribeDBInstances(rparams)
+	if rerr != nil {
+		return "", rerr
+	}
+	fmt.Println(name + " Status: " + *rresp.DBInstances[0].DBInstanceStatus)
+	return *rresp.DBInstances[0].DBInstanceStatus, nil
+}
 
+// Returns whether an instance status means it will never become available on its own
+func isFailedStatus(status string) bool {
+	return status == "failed" || status == "inaccessible-encryption-credentials" || strings.HasPrefix(status, "incompatible-")
+}
+
+// Returns the resource ID that IAM policies use to refer to a cluster
+func getClusterResourceID(name string) (string, error) {
+	svc := cloud.Neptune()
+
+	resp, err := svc.DescribeDBClusters(&neptune.DescribeDBClustersInput{
+		DBClusterIdentifier: aws.String(name),
+	})
 	if err != nil {
-		fmt.Println(err.Error())
-		return
+		return "", err
 	}
+	return *resp.DBClusters[0].DbClusterResourceId, nil
+}
 
+// Delete a cluster without taking a final snapshot
+func deleteCluster(name string) error {
+	svc := cloud.Neptune()
+
+	_, err := svc.DeleteDBCluster(&neptune.DeleteDBClusterInput{
+		DBClusterIdentifier: aws.String(name),
+		SkipFinalSnapshot:   aws.Bool(true),
+	})
+	return err
+}
+
+// Delete an instance without taking a final snapshot
+func deleteInstance(name string) error {
+	svc := cloud.Neptune()
+
+	_, err := svc.DeleteDBInstance(&neptune.DeleteDBInstanceInput{
+		DBInstanceIdentifier: aws.String(name),
+		SkipFinalSnapshot:    aws.Bool(true),
+	})
+	return err
 }
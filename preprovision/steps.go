@@ -0,0 +1,61 @@
+package preprovision
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+// step is one unit of provisioning work along with the compensating action that undoes it.
+// Steps with a nil Do were completed by an earlier run and are only undone.
+type step struct {
+	Name string
+	Do   func() error
+	Undo func() error
+}
+
+// Runs steps in order, recording each in provision_steps. If a step fails, every step
+// before it is undone in reverse order and the original error is returned.
+func runSteps(db *sql.DB, name string, steps []step) error {
+	for i, s := range steps {
+		if s.Do == nil {
+			continue
+		}
+
+		err := s.Do()
+		recordStep(db, name, s.Name, "do", err)
+		if err == nil {
+			continue
+		}
+
+		fmt.Println("Step '" + s.Name + "' failed for " + name + ": " + err.Error())
+		fmt.Println("Rolling back " + name + "...")
+		for j := i - 1; j >= 0; j-- {
+			if steps[j].Undo == nil {
+				continue
+			}
+			uerr := steps[j].Undo()
+			recordStep(db, name, steps[j].Name, "undo", uerr)
+			if uerr != nil {
+				fmt.Println("Unable to undo step '" + steps[j].Name + "' for " + name + ": " + uerr.Error())
+			}
+		}
+		return errors.New(s.Name + ": " + err.Error())
+	}
+	return nil
+}
+
+// Records the outcome of a step or its rollback
+func recordStep(db *sql.DB, name string, stepName string, action string, stepErr error) {
+	status := "succeeded"
+	message := ""
+	if stepErr != nil {
+		status = "failed"
+		message = stepErr.Error()
+	}
+
+	_, err := db.Exec("INSERT INTO provision_steps(name, step, action, status, error) VALUES ($1, $2, $3, $4, $5)", name, stepName, action, status, message)
+	if err != nil {
+		fmt.Println(err)
+	}
+}
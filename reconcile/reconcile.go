@@ -0,0 +1,507 @@
+package reconcile
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	cloud "neptune-aws-api/cloud"
+	lifecycle "neptune-aws-api/lifecycle"
+	secrets "neptune-aws-api/secrets"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/iam"
+	"github.com/aws/aws-sdk-go/service/neptune"
+)
+
+// Report describes the drift between the provision table and AWS. Orphans exist in AWS
+// without a live row, missing resources belong to a live row but do not exist in AWS.
+type Report struct {
+	Generated         time.Time `json:"generated"`
+	Fix               bool      `json:"fix"`
+	OrphanedClusters  []string  `json:"orphaned_clusters"`
+	OrphanedUsers     []string  `json:"orphaned_users"`
+	OrphanedPolicies  []string  `json:"orphaned_policies"`
+	MissingClusters   []string  `json:"missing_clusters"`
+	MissingUsers      []string  `json:"missing_users"`
+	MissingAccessKeys []string  `json:"missing_access_keys"`
+	MissingPolicies   []string  `json:"missing_policies"`
+	Actions           []Action  `json:"actions"`
+}
+
+// Action is a repair made while reconciling
+type Action struct {
+	Resource string `json:"resource"`
+	Action   string `json:"action"`
+	Error    string `json:"error,omitempty"`
+}
+
+type row struct {
+	state     string
+	accesskey string
+}
+
+// Run compares the provision table with the Neptune clusters, IAM users and IAM policies
+// named with NAME_PREFIX. If fix is set, orphans are deleted, missing access keys are
+// recreated, rows missing their cluster, user or policy are marked failed and the tags of
+// clusters are copied into the tags table.
+func Run(db *sql.DB, fix bool) (Report, error) {
+	report := Report{
+		Generated:         time.Now().UTC(),
+		Fix:               fix,
+		OrphanedClusters:  []string{},
+		OrphanedUsers:     []string{},
+		OrphanedPolicies:  []string{},
+		MissingClusters:   []string{},
+		MissingUsers:      []string{},
+		MissingAccessKeys: []string{},
+		MissingPolicies:   []string{},
+		Actions:           []Action{},
+	}
+
+	prefix := os.Getenv("NAME_PREFIX")
+	if prefix == "" {
+		return report, errors.New("Missing NAME_PREFIX environment variable")
+	}
+
+	rows, err := getRows(db)
+	if err != nil {
+		return report, err
+	}
+	bindings, err := getBindings(db)
+	if err != nil {
+		return report, err
+	}
+	clusters, err := getClusters(prefix)
+	if err != nil {
+		return report, err
+	}
+	users, err := getUsers(prefix)
+	if err != nil {
+		return report, err
+	}
+	policies, err := getPolicies(prefix)
+	if err != nil {
+		return report, err
+	}
+
+	for _, name := range sortedKeys(clusters) {
+		r, ok := rows[name]
+		if aws.StringValue(clusters[name].Status) == "deleting" {
+			continue
+		}
+		if !ok || r.state == lifecycle.Failed {
+			report.OrphanedClusters = append(report.OrphanedClusters, name)
+		}
+	}
+	for _, name := range sortedKeys(users) {
+		if bindings[name] {
+			continue
+		}
+		if r, ok := rows[name]; !ok || !hasIAM(r.state) {
+			report.OrphanedUsers = append(report.OrphanedUsers, name)
+		}
+	}
+	for _, name := range sortedKeys(policies) {
+		if bindings[name] {
+			continue
+		}
+		if r, ok := rows[name]; !ok || !hasIAM(r.state) {
+			report.OrphanedPolicies = append(report.OrphanedPolicies, name+"policy")
+		}
+	}
+
+	for _, name := range sortedKeys(rows) {
+		r := rows[name]
+		if hasIAM(r.state) {
+			if _, ok := clusters[name]; !ok {
+				report.MissingClusters = append(report.MissingClusters, name)
+			}
+		}
+		if r.state != lifecycle.Available && r.state != lifecycle.Claimed && r.state != lifecycle.Stopped && r.state != lifecycle.Starting {
+			continue
+		}
+		if _, ok := users[name]; !ok {
+			report.MissingUsers = append(report.MissingUsers, name)
+		} else {
+			present, kerr := hasAccessKey(name, r.accesskey)
+			if kerr != nil {
+				return report, kerr
+			}
+			if !present {
+				report.MissingAccessKeys = append(report.MissingAccessKeys, name)
+			}
+		}
+		if _, ok := policies[name]; !ok {
+			report.MissingPolicies = append(report.MissingPolicies, name+"policy")
+		}
+	}
+
+	if fix {
+		repair(db, &report, rows, clusters, policies)
+	}
+	return report, nil
+}
+
+// Print runs the reconciler and writes its report to the console
+func Print(db *sql.DB, fix bool) {
+	report, err := Run(db, fix)
+	if err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+
+	fmt.Println("Reconciled provision table with AWS at " + report.Generated.String())
+	printList("Orphaned clusters", report.OrphanedClusters)
+	printList("Orphaned IAM users", report.OrphanedUsers)
+	printList("Orphaned IAM policies", report.OrphanedPolicies)
+	printList("Missing clusters", report.MissingClusters)
+	printList("Missing IAM users", report.MissingUsers)
+	printList("Missing access keys", report.MissingAccessKeys)
+	printList("Missing IAM policies", report.MissingPolicies)
+	for _, action := range report.Actions {
+		if action.Error != "" {
+			fmt.Println("   " + action.Action + " " + action.Resource + " failed: " + action.Error)
+		} else {
+			fmt.Println("   " + action.Action + " " + action.Resource)
+		}
+	}
+	fmt.Println("")
+}
+
+func printList(title string, names []string) {
+	fmt.Println(title + ": " + fmt.Sprint(len(names)))
+	for _, name := range names {
+		fmt.Println("   " + name)
+	}
+}
+
+// Rows that are expected to have an IAM user and policy, or are in the middle of getting them.
+// Soft deleted instances keep theirs, deactivated, until they are deleted.
+func hasIAM(state string) bool {
+	return state == lifecycle.IAMPending || state == lifecycle.Available || state == lifecycle.Claimed || state == lifecycle.Stopped || state == lifecycle.Starting || state == lifecycle.PendingDeletion
+}
+
+func repair(db *sql.DB, report *Report, rows map[string]row, clusters map[string]*neptune.DBCluster, policies map[string]string) {
+	act := func(resource string, action string, err error) {
+		a := Action{Resource: resource, Action: action}
+		if err != nil {
+			a.Error = err.Error()
+		}
+		report.Actions = append(report.Actions, a)
+	}
+
+	for _, name := range report.OrphanedClusters {
+		act(name, "delete cluster", deleteCluster(clusters[name]))
+	}
+	for _, name := range report.OrphanedUsers {
+		act(name, "delete user", deleteUser(name))
+	}
+	for _, policyname := range report.OrphanedPolicies {
+		name := strings.TrimSuffix(policyname, "policy")
+		act(policyname, "delete policy", deletePolicy(policies[name]))
+	}
+	for _, name := range report.MissingAccessKeys {
+		act(name, "recreate access key", recreateAccessKey(db, name))
+	}
+
+	failed := make(map[string]bool)
+	for _, name := range report.MissingClusters {
+		failed[name] = true
+	}
+	for _, name := range report.MissingUsers {
+		failed[name] = true
+	}
+	for _, policyname := range report.MissingPolicies {
+		failed[strings.TrimSuffix(policyname, "policy")] = true
+	}
+	for _, name := range sortedKeys(failed) {
+		act(name, "mark failed", lifecycle.Transition(db, name, rows[name].state, lifecycle.Failed))
+	}
+
+	for _, name := range sortedKeys(rows) {
+		cluster, ok := clusters[name]
+		if !ok {
+			continue
+		}
+		copied, err := copyTags(db, name, cluster)
+		if err != nil || copied > 0 {
+			act(name, "copy tags", err)
+		}
+	}
+}
+
+// Copy the tags of the cluster of a row into the tags table, which the instance list filters
+// on and which is otherwise only filled by /v1/neptune/tag. The billingcode tag is kept in its
+// own column. Returns how many tags were added or changed.
+func copyTags(db *sql.DB, name string, cluster *neptune.DBCluster) (int64, error) {
+	resp, err := cloud.Neptune().ListTagsForResource(&neptune.ListTagsForResourceInput{
+		ResourceName: cluster.DBClusterArn,
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	var copied int64
+	for _, tag := range resp.TagList {
+		if aws.StringValue(tag.Key) == "billingcode" {
+			continue
+		}
+		result, err := db.Exec("INSERT INTO tags(name, key, value) VALUES ($1, $2, $3) ON CONFLICT (name, key) DO UPDATE SET value=excluded.value WHERE tags.value <> excluded.value", name, aws.StringValue(tag.Key), aws.StringValue(tag.Value))
+		if err != nil {
+			return copied, err
+		}
+		n, _ := result.RowsAffected()
+		copied += n
+	}
+	return copied, nil
+}
+
+func getRows(db *sql.DB) (map[string]row, error) {
+	result, err := db.Query("SELECT name, state, coalesce(accesskey, '') FROM provision WHERE state <> $1", lifecycle.Deleted)
+	if err != nil {
+		return nil, err
+	}
+	defer result.Close()
+
+	rows := make(map[string]row)
+	for result.Next() {
+		var name string
+		var r row
+		err = result.Scan(&name, &r.state, &r.accesskey)
+		if err != nil {
+			return nil, err
+		}
+		// Access key IDs are stored encrypted, and compared with IAM in plaintext
+		r.accesskey, err = secrets.Decrypt(r.accesskey)
+		if err != nil {
+			return nil, err
+		}
+		rows[name] = r
+	}
+	return rows, result.Err()
+}
+
+// Returns the IAM usernames of every binding, which share the instance name prefix but have no row of their own
+func getBindings(db *sql.DB) (map[string]bool, error) {
+	result, err := db.Query("SELECT username FROM bindings")
+	if err != nil {
+		return nil, err
+	}
+	defer result.Close()
+
+	bindings := make(map[string]bool)
+	for result.Next() {
+		var username string
+		err = result.Scan(&username)
+		if err != nil {
+			return nil, err
+		}
+		bindings[username] = true
+	}
+	return bindings, result.Err()
+}
+
+func getClusters(prefix string) (map[string]*neptune.DBCluster, error) {
+	svc := cloud.Neptune()
+
+	clusters := make(map[string]*neptune.DBCluster)
+	input := &neptune.DescribeDBClustersInput{MaxRecords: aws.Int64(100)}
+	for {
+		resp, err := svc.DescribeDBClusters(input)
+		if err != nil {
+			return nil, err
+		}
+		for _, cluster := range resp.DBClusters {
+			name := aws.StringValue(cluster.DBClusterIdentifier)
+			if strings.HasPrefix(name, prefix) {
+				clusters[name] = cluster
+			}
+		}
+		if resp.Marker == nil {
+			return clusters, nil
+		}
+		input.Marker = resp.Marker
+	}
+}
+
+func getUsers(prefix string) (map[string]bool, error) {
+	svc := cloud.IAM()
+
+	users := make(map[string]bool)
+	input := &iam.ListUsersInput{}
+	for {
+		resp, err := svc.ListUsers(input)
+		if err != nil {
+			return nil, err
+		}
+		for _, user := range resp.Users {
+			name := aws.StringValue(user.UserName)
+			if strings.HasPrefix(name, prefix) {
+				users[name] = true
+			}
+		}
+		if !aws.BoolValue(resp.IsTruncated) {
+			return users, nil
+		}
+		input.Marker = resp.Marker
+	}
+}
+
+// Returns the ARN of every broker policy, keyed by the name of the instance it belongs to
+func getPolicies(prefix string) (map[string]string, error) {
+	svc := cloud.IAM()
+
+	policies := make(map[string]string)
+	input := &iam.ListPoliciesInput{Scope: aws.String(iam.PolicyScopeTypeLocal)}
+	for {
+		resp, err := svc.ListPolicies(input)
+		if err != nil {
+			return nil, err
+		}
+		for _, policy := range resp.Policies {
+			name := aws.StringValue(policy.PolicyName)
+			if strings.HasPrefix(name, prefix) && strings.HasSuffix(name, "policy") {
+				policies[strings.TrimSuffix(name, "policy")] = aws.StringValue(policy.Arn)
+			}
+		}
+		if !aws.BoolValue(resp.IsTruncated) {
+			return policies, nil
+		}
+		input.Marker = resp.Marker
+	}
+}
+
+func hasAccessKey(username string, accesskey string) (bool, error) {
+	svc := cloud.IAM()
+
+	resp, err := svc.ListAccessKeys(&iam.ListAccessKeysInput{UserName: aws.String(username)})
+	if err != nil {
+		return false, err
+	}
+	for _, key := range resp.AccessKeyMetadata {
+		if aws.StringValue(key.AccessKeyId) == accesskey {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Delete every instance in a cluster and then the cluster itself
+func deleteCluster(cluster *neptune.DBCluster) error {
+	svc := cloud.Neptune()
+
+	for _, member := range cluster.DBClusterMembers {
+		_, err := svc.DeleteDBInstance(&neptune.DeleteDBInstanceInput{
+			DBInstanceIdentifier: member.DBInstanceIdentifier,
+			SkipFinalSnapshot:    aws.Bool(true),
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err := svc.DeleteDBCluster(&neptune.DeleteDBClusterInput{
+		DBClusterIdentifier: cluster.DBClusterIdentifier,
+		SkipFinalSnapshot:   aws.Bool(true),
+	})
+	return err
+}
+
+// Detach the policies and delete the access keys of a user, then the user itself
+func deleteUser(username string) error {
+	svc := cloud.IAM()
+
+	attached, err := svc.ListAttachedUserPolicies(&iam.ListAttachedUserPoliciesInput{UserName: aws.String(username)})
+	if err != nil {
+		return err
+	}
+	for _, policy := range attached.AttachedPolicies {
+		_, err = svc.DetachUserPolicy(&iam.DetachUserPolicyInput{PolicyArn: policy.PolicyArn, UserName: aws.String(username)})
+		if err != nil {
+			return err
+		}
+	}
+
+	keys, err := svc.ListAccessKeys(&iam.ListAccessKeysInput{UserName: aws.String(username)})
+	if err != nil {
+		return err
+	}
+	for _, key := range keys.AccessKeyMetadata {
+		_, err = svc.DeleteAccessKey(&iam.DeleteAccessKeyInput{AccessKeyId: key.AccessKeyId, UserName: aws.String(username)})
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = svc.DeleteUser(&iam.DeleteUserInput{UserName: aws.String(username)})
+	return err
+}
+
+func deletePolicy(policyarn string) error {
+	svc := cloud.IAM()
+
+	_, err := svc.DeletePolicy(&iam.DeletePolicyInput{PolicyArn: aws.String(policyarn)})
+	return err
+}
+
+// Replace the access keys of a user with a new one and store it in the provision table
+func recreateAccessKey(db *sql.DB, username string) error {
+	svc := cloud.IAM()
+
+	keys, err := svc.ListAccessKeys(&iam.ListAccessKeysInput{UserName: aws.String(username)})
+	if err != nil {
+		return err
+	}
+	for _, key := range keys.AccessKeyMetadata {
+		_, err = svc.DeleteAccessKey(&iam.DeleteAccessKeyInput{AccessKeyId: key.AccessKeyId, UserName: aws.String(username)})
+		if err != nil {
+			return err
+		}
+	}
+
+	resp, err := svc.CreateAccessKey(&iam.CreateAccessKeyInput{UserName: aws.String(username)})
+	if err != nil {
+		return err
+	}
+
+	secretkey, err := secrets.Encrypt(*resp.AccessKey.SecretAccessKey)
+	if err != nil {
+		return err
+	}
+
+	accesskey, err := secrets.Encrypt(*resp.AccessKey.AccessKeyId)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("UPDATE provision SET accesskey=$1, secretkey=$2, keycreated=now() WHERE name=$3", accesskey, secretkey, username)
+	return err
+}
+
+func sortedKeys(m interface{}) []string {
+	var keys []string
+	switch v := m.(type) {
+	case map[string]row:
+		for k := range v {
+			keys = append(keys, k)
+		}
+	case map[string]*neptune.DBCluster:
+		for k := range v {
+			keys = append(keys, k)
+		}
+	case map[string]bool:
+		for k := range v {
+			keys = append(keys, k)
+		}
+	case map[string]string:
+		for k := range v {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
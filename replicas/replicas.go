@@ -0,0 +1,182 @@
+package replicas
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+
+	cloud "neptune-aws-api/cloud"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/neptune"
+	uuid "github.com/nu7hatch/gouuid"
+)
+
+// Create adds a reader instance with the given instance class to the cluster of an instance
+// and records it in the replicas table. It is placed in zone, or wherever AWS picks if zone is
+// empty.
+func Create(db *sql.DB, name string, instanceclass string, zone string) (id string, status string, err error) {
+	var billingcode string
+	err = db.QueryRow("SELECT coalesce(billingcode, '') FROM provision WHERE name=$1", name).Scan(&billingcode)
+	if err != nil {
+		return "", "", err
+	}
+
+	replicauuid, _ := uuid.NewV4()
+	id = name + "-replica-" + strings.Split(replicauuid.String(), "-")[0]
+
+	input := &neptune.CreateDBInstanceInput{
+		DBClusterIdentifier:  aws.String(name),
+		DBInstanceClass:      aws.String(instanceclass),
+		DBInstanceIdentifier: aws.String(id),
+		Engine:               aws.String("neptune"),
+		Tags: []*neptune.Tag{
+			{
+				Key:   aws.String("Name"),
+				Value: aws.String(id),
+			},
+			{
+				Key:   aws.String("billingcode"),
+				Value: aws.String(billingcode),
+			},
+		},
+	}
+	if zone != "" {
+		input.AvailabilityZone = aws.String(zone)
+	}
+
+	svc := cloud.Neptune()
+	resp, err := svc.CreateDBInstance(input)
+	if err != nil {
+		return "", "", err
+	}
+
+	status = aws.StringValue(resp.DBInstance.DBInstanceStatus)
+	_, err = db.Exec("INSERT INTO replicas(id, name, instanceclass, status) VALUES ($1, $2, $3, $4)", id, name, instanceclass, status)
+	if err != nil {
+		return "", "", err
+	}
+	fmt.Println("Creating replica " + id + " of " + name)
+	return id, status, nil
+}
+
+// Delete asks AWS to delete a replica and records that it is being deleted, or that it is
+// already gone
+func Delete(db *sql.DB, id string) (status string, err error) {
+	svc := cloud.Neptune()
+	_, err = svc.DeleteDBInstance(&neptune.DeleteDBInstanceInput{
+		DBInstanceIdentifier: aws.String(id),
+		SkipFinalSnapshot:    aws.Bool(true),
+	})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == neptune.ErrCodeDBInstanceNotFoundFault {
+		status = "deleted"
+	} else if err != nil {
+		return "", err
+	} else {
+		status = "deleting"
+	}
+	fmt.Println("Deletion in progress for replica " + id)
+
+	_, err = db.Exec("UPDATE replicas SET status=$1 WHERE id=$2", status, id)
+	if err != nil {
+		return "", err
+	}
+	return status, nil
+}
+
+// Active returns the number of replicas of an instance that exist or are being created
+func Active(db *sql.DB, name string) (int, error) {
+	var count int
+	err := db.QueryRow("SELECT count(*) FROM replicas WHERE name=$1 AND status NOT IN ('deleting', 'deleted', 'failed')", name).Scan(&count)
+	return count, err
+}
+
+// IDs returns the replicas of an instance that exist or are being created, oldest first
+func IDs(db *sql.DB, name string) ([]string, error) {
+	rows, err := db.Query("SELECT id FROM replicas WHERE name=$1 AND status NOT IN ('deleting', 'deleted', 'failed') ORDER BY created", name)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		err = rows.Scan(&id)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// Writer returns the identifier of the instance that is currently the writer of the cluster of
+// an instance. After a failover this is one of its replicas.
+func Writer(name string) (string, error) {
+	resp, err := cloud.Neptune().DescribeDBClusters(&neptune.DescribeDBClustersInput{
+		DBClusterIdentifier: aws.String(name),
+	})
+	if err != nil {
+		return "", err
+	}
+	for _, m := range resp.DBClusters[0].DBClusterMembers {
+		if aws.BoolValue(m.IsClusterWriter) {
+			return aws.StringValue(m.DBInstanceIdentifier), nil
+		}
+	}
+	return "", nil
+}
+
+// Resize moves every replica of an instance to an instance class, asking AWS to modify those
+// that are available and neither on it nor being moved to it. It returns whether all of them
+// are on it, so callers can repeat it until they are.
+func Resize(db *sql.DB, name string, instanceclass string, applyImmediately bool) (bool, error) {
+	ids, err := IDs(db, name)
+	if err != nil {
+		return false, err
+	}
+
+	svc := cloud.Neptune()
+	done := true
+	for _, id := range ids {
+		resp, err := svc.DescribeDBInstances(&neptune.DescribeDBInstancesInput{
+			DBInstanceIdentifier: aws.String(id),
+		})
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == neptune.ErrCodeDBInstanceNotFoundFault {
+			continue
+		} else if err != nil {
+			return false, err
+		}
+		instance := resp.DBInstances[0]
+
+		var pending string
+		if instance.PendingModifiedValues != nil {
+			pending = aws.StringValue(instance.PendingModifiedValues.DBInstanceClass)
+		}
+		status := aws.StringValue(instance.DBInstanceStatus)
+		switch {
+		case aws.StringValue(instance.DBInstanceClass) == instanceclass && pending == "" && status == "available":
+			_, err = db.Exec("UPDATE replicas SET instanceclass=$1 WHERE id=$2", instanceclass, id)
+			if err != nil {
+				return false, err
+			}
+			continue
+		case pending == instanceclass || status != "available":
+			// Being moved already, or busy and picked up on a later call
+		default:
+			fmt.Println("Changing instance class of replica " + id + " to " + instanceclass)
+			_, err = svc.ModifyDBInstance(&neptune.ModifyDBInstanceInput{
+				DBInstanceIdentifier: aws.String(id),
+				DBInstanceClass:      aws.String(instanceclass),
+				ApplyImmediately:     aws.Bool(applyImmediately),
+			})
+			if err != nil {
+				return false, err
+			}
+		}
+		done = false
+	}
+	return done, nil
+}
@@ -0,0 +1,211 @@
+package rotation
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	credentials "neptune-aws-api/credentials"
+	lifecycle "neptune-aws-api/lifecycle"
+	secrets "neptune-aws-api/secrets"
+)
+
+// Statuses of a rotation, which is pending until its old access key has been deleted
+const (
+	Pending = "pending"
+	Done    = "done"
+)
+
+// ErrPending is returned when the old access key of an earlier rotation still exists
+var ErrPending = errors.New("A rotation is already in progress, the previous access key has not been deleted yet")
+
+// ErrNotRotatable is returned when an instance is not in a state whose access key can be rotated
+var ErrNotRotatable = errors.New("Only available and claimed instances can have their access key rotated")
+
+const defaultOverlap = 24 * time.Hour
+
+// Overlap is how long the old access key keeps working after a rotation, ROTATION_OVERLAP if set
+func Overlap() time.Duration {
+	overlap, err := time.ParseDuration(os.Getenv("ROTATION_OVERLAP"))
+	if err != nil || overlap < 0 {
+		return defaultOverlap
+	}
+	return overlap
+}
+
+// MaxAge is how old an access key may get before it is rotated on schedule, ROTATION_MAX_AGE.
+// Scheduled rotation is disabled when it is not set.
+func MaxAge() time.Duration {
+	maxage, err := time.ParseDuration(os.Getenv("ROTATION_MAX_AGE"))
+	if err != nil || maxage <= 0 {
+		return 0
+	}
+	return maxage
+}
+
+// Rotate creates a second access key for an instance, stores it in the provision row and
+// schedules the old access key for deletion once the overlap period has passed
+func Rotate(db *sql.DB, name string) (accesskey string, secretkey string, err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return "", "", err
+	}
+	defer tx.Rollback()
+
+	var oldkey, state string
+	err = tx.QueryRow("SELECT coalesce(accesskey, ''), state FROM provision WHERE name=$1 FOR UPDATE", name).Scan(&oldkey, &state)
+	if err != nil {
+		return "", "", err
+	}
+	if (state != lifecycle.Available && state != lifecycle.Claimed) || oldkey == "" {
+		return "", "", ErrNotRotatable
+	}
+	oldkey, err = secrets.Decrypt(oldkey)
+	if err != nil {
+		return "", "", err
+	}
+
+	var pending int
+	err = tx.QueryRow("SELECT count(*) FROM rotations WHERE name=$1 AND status=$2", name, Pending).Scan(&pending)
+	if err != nil {
+		return "", "", err
+	}
+	if pending > 0 {
+		return "", "", ErrPending
+	}
+
+	accesskey, secretkey, err = credentials.CreateAccessKey(name)
+	if err != nil {
+		return "", "", err
+	}
+
+	err = record(tx, name, oldkey, accesskey, secretkey)
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		credentials.DeleteAccessKey(name, accesskey)
+		return "", "", err
+	}
+
+	fmt.Println("Rotated access key of " + name + ", " + oldkey + " will be deleted in " + Overlap().String())
+	return accesskey, secretkey, nil
+}
+
+// Access key IDs are stored encrypted like secret keys, in the rotation as well
+func record(tx *sql.Tx, name string, oldkey string, accesskey string, secretkey string) error {
+	encryptedOld, err := secrets.Encrypt(oldkey)
+	if err != nil {
+		return err
+	}
+	encryptedNew, err := secrets.Encrypt(accesskey)
+	if err != nil {
+		return err
+	}
+	encryptedSecret, err := secrets.Encrypt(secretkey)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("UPDATE provision SET accesskey=$1, secretkey=$2, keycreated=now() WHERE name=$3", encryptedNew, encryptedSecret, name)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("INSERT INTO rotations(name, oldkey, newkey, status, deleteafter) VALUES ($1, $2, $3, $4, now() + $5 * interval '1 second')", name, encryptedOld, encryptedNew, Pending, int64(Overlap().Seconds()))
+	return err
+}
+
+// Run deletes the old access keys of rotations whose overlap period has passed and, when
+// ROTATION_MAX_AGE is set, rotates every access key older than it
+func Run(db *sql.DB) {
+	finishRotations(db)
+
+	maxage := MaxAge()
+	if maxage == 0 {
+		return
+	}
+
+	names, err := expired(db, maxage)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	for _, name := range names {
+		fmt.Println("Access key of " + name + " is older than " + maxage.String() + ", rotating...")
+		_, _, err = Rotate(db, name)
+		if err != nil && err != ErrPending {
+			fmt.Println(err)
+		}
+	}
+}
+
+type rotation struct {
+	id     int
+	name   string
+	oldkey string
+}
+
+// Delete the old access keys of pending rotations that are due. Failures are recorded on the
+// rotation and retried on the next run.
+func finishRotations(db *sql.DB) {
+	rows, err := db.Query("SELECT id, name, oldkey FROM rotations WHERE status=$1 AND deleteafter <= now() ORDER BY id", Pending)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	var due []rotation
+	for rows.Next() {
+		var r rotation
+		err = rows.Scan(&r.id, &r.name, &r.oldkey)
+		if err != nil {
+			fmt.Println(err)
+			rows.Close()
+			return
+		}
+		due = append(due, r)
+	}
+	rows.Close()
+
+	for _, r := range due {
+		r.oldkey, err = secrets.Decrypt(r.oldkey)
+		if err != nil {
+			fmt.Println(err)
+			continue
+		}
+		fmt.Println("Deleting old access key " + r.oldkey + " of " + r.name + "...")
+		err = credentials.DeleteAccessKey(r.name, r.oldkey)
+		if err != nil && !credentials.IsNotFound(err) {
+			fmt.Println(err)
+			_, err = db.Exec("UPDATE rotations SET error=$1 WHERE id=$2", err.Error(), r.id)
+		} else {
+			_, err = db.Exec("UPDATE rotations SET status=$1, error=NULL, finished=now() WHERE id=$2", Done, r.id)
+		}
+		if err != nil {
+			fmt.Println(err)
+		}
+	}
+}
+
+// Returns the instances whose access key is older than maxage
+func expired(db *sql.DB, maxage time.Duration) ([]string, error) {
+	rows, err := db.Query("SELECT name FROM provision WHERE state in ($1, $2) AND coalesce(accesskey, '') <> '' AND keycreated < now() - $3 * interval '1 second' ORDER BY keycreated", lifecycle.Available, lifecycle.Claimed, int64(maxage.Seconds()))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var names []string
+	for rows.Next() {
+		var name string
+		err = rows.Scan(&name)
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	return names, rows.Err()
+}
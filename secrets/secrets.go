@@ -0,0 +1,274 @@
+package secrets
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	cloud "neptune-aws-api/cloud"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kms"
+)
+
+// Encrypted values are stored as this prefix followed by the base64 of the length of the
+// wrapped data key, the wrapped data key, the nonce and the AES-GCM sealed value
+const prefix = "enc:v1:"
+
+var errNotConfigured = errors.New("Secret encryption is not configured, set KMS_KEY_ID or SECRETS_KEY_FILE")
+var errMalformed = errors.New("Encrypted secret is malformed")
+
+// A keyWrapper hands out a fresh data key for every value, along with the wrapped copy
+// that is stored next to the value, and unwraps stored data keys again
+type keyWrapper interface {
+	dataKey() (plaintext []byte, wrapped []byte, err error)
+	unwrap(wrapped []byte) ([]byte, error)
+}
+
+var wrapper keyWrapper
+
+// Init selects how data keys are wrapped. A local key file takes precedence over the KMS key,
+// so that development doesn't need KMS access.
+func Init(keyfile string, kmsKeyID string) error {
+	if keyfile != "" {
+		key, err := readKeyFile(keyfile)
+		if err != nil {
+			return err
+		}
+		wrapper = &localWrapper{key: key}
+		return nil
+	}
+	if kmsKeyID != "" {
+		wrapper = &kmsWrapper{keyID: kmsKeyID}
+		return nil
+	}
+	return errNotConfigured
+}
+
+// A key file holds a 32 byte key, either raw or base64 encoded
+func readKeyFile(keyfile string) ([]byte, error) {
+	contents, err := ioutil.ReadFile(keyfile)
+	if err != nil {
+		return nil, errors.New("Unable to read SECRETS_KEY_FILE: " + err.Error())
+	}
+	if len(contents) == 32 {
+		return contents, nil
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(contents)))
+	if err != nil || len(key) != 32 {
+		return nil, errors.New("SECRETS_KEY_FILE must contain a 32 byte key, raw or base64 encoded")
+	}
+	return key, nil
+}
+
+// IsEncrypted returns whether a stored value was written by Encrypt
+func IsEncrypted(value string) bool {
+	return strings.HasPrefix(value, prefix)
+}
+
+// Encrypt seals a value with a new data key and returns it in the form it is stored in
+func Encrypt(plaintext string) (string, error) {
+	if wrapper == nil {
+		return "", errNotConfigured
+	}
+
+	key, wrapped, err := wrapper.dataKey()
+	if err != nil {
+		return "", err
+	}
+	sealed, err := seal(key, []byte(plaintext))
+	if err != nil {
+		return "", err
+	}
+
+	out := make([]byte, 2, 2+len(wrapped)+len(sealed))
+	binary.BigEndian.PutUint16(out, uint16(len(wrapped)))
+	out = append(out, wrapped...)
+	out = append(out, sealed...)
+	return prefix + base64.StdEncoding.EncodeToString(out), nil
+}
+
+// Decrypt returns the plaintext of a stored value. Values written before encryption was
+// introduced are returned unchanged until they are encrypted with EncryptRows, so every stored
+// access key ID and secret key is read through it.
+func Decrypt(value string) (string, error) {
+	if !IsEncrypted(value) {
+		return value, nil
+	}
+	if wrapper == nil {
+		return "", errNotConfigured
+	}
+
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(value, prefix))
+	if err != nil || len(raw) < 2 {
+		return "", errMalformed
+	}
+	n := int(binary.BigEndian.Uint16(raw))
+	if len(raw) < 2+n {
+		return "", errMalformed
+	}
+
+	key, err := wrapper.unwrap(raw[2 : 2+n])
+	if err != nil {
+		return "", err
+	}
+	plaintext, err := open(key, raw[2+n:])
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
+
+// EncryptRows encrypts every access key ID and secret key that is still stored in plaintext, in
+// the provision, bindings and rotations tables
+func EncryptRows(db *sql.DB) (int, error) {
+	columns := []struct {
+		table  string
+		id     string
+		column string
+	}{
+		{"provision", "name", "accesskey"},
+		{"provision", "name", "secretkey"},
+		{"bindings", "id", "accesskey"},
+		{"rotations", "id", "oldkey"},
+		{"rotations", "id", "newkey"},
+	}
+
+	count := 0
+	for _, c := range columns {
+		n, err := encryptColumn(db, c.table, c.id, c.column)
+		count += n
+		if err != nil {
+			return count, err
+		}
+	}
+	return count, nil
+}
+
+func encryptColumn(db *sql.DB, table string, id string, column string) (int, error) {
+	rows, err := db.Query("SELECT "+id+", "+column+" FROM "+table+" WHERE coalesce("+column+", '') <> '' AND "+column+" NOT LIKE $1", prefix+"%")
+	if err != nil {
+		return 0, err
+	}
+
+	plaintexts := make(map[string]string)
+	for rows.Next() {
+		var key, value string
+		err = rows.Scan(&key, &value)
+		if err != nil {
+			rows.Close()
+			return 0, err
+		}
+		plaintexts[key] = value
+	}
+	rows.Close()
+
+	count := 0
+	for key, value := range plaintexts {
+		encrypted, err := Encrypt(value)
+		if err != nil {
+			return count, err
+		}
+		// Only replace the value that was read, in case the key was rotated in the meantime
+		result, err := db.Exec("UPDATE "+table+" SET "+column+"=$1 WHERE "+id+"=$2 AND "+column+"=$3", encrypted, key, value)
+		if err != nil {
+			return count, err
+		}
+		if n, _ := result.RowsAffected(); n > 0 {
+			fmt.Println("Encrypted " + column + " of " + table + " " + key)
+			count++
+		}
+	}
+	return count, nil
+}
+
+func seal(key []byte, plaintext []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+func open(key []byte, sealed []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, errMalformed
+	}
+	plaintext, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], nil)
+	if err != nil {
+		return nil, errors.New("Unable to decrypt secret: " + err.Error())
+	}
+	return plaintext, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Data keys generated and wrapped by a KMS key
+type kmsWrapper struct {
+	keyID string
+}
+
+func (w *kmsWrapper) dataKey() ([]byte, []byte, error) {
+	resp, err := cloud.KMS().GenerateDataKey(&kms.GenerateDataKeyInput{
+		KeyId:   aws.String(w.keyID),
+		KeySpec: aws.String(kms.DataKeySpecAes256),
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return resp.Plaintext, resp.CiphertextBlob, nil
+}
+
+func (w *kmsWrapper) unwrap(wrapped []byte) ([]byte, error) {
+	resp, err := cloud.KMS().Decrypt(&kms.DecryptInput{
+		CiphertextBlob: wrapped,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Plaintext, nil
+}
+
+// Data keys generated locally and wrapped with the key from a key file
+type localWrapper struct {
+	key []byte
+}
+
+func (w *localWrapper) dataKey() ([]byte, []byte, error) {
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	wrapped, err := seal(w.key, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return key, wrapped, nil
+}
+
+func (w *localWrapper) unwrap(wrapped []byte) ([]byte, error) {
+	return open(w.key, wrapped)
+}
@@ -0,0 +1,225 @@
+package teardown
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	credentials "neptune-aws-api/credentials"
+)
+
+// Statuses of a teardown job, which is pending until the IAM user it removes is gone
+const (
+	Pending = "pending"
+	Done    = "done"
+)
+
+// StuckAttempts is the number of failed attempts after which a job is reported as stuck
+const StuckAttempts = 5
+
+const maxBackoff = 6 * time.Hour
+
+// While a job is being attempted it is leased, so that the API and the preprovisioner don't
+// attempt it at the same time
+const lease = 10 * time.Minute
+
+// Job removes the IAM user, access keys and policy of an instance or of one of its bindings
+type Job struct {
+	ID          int        `json:"id"`
+	Name        string     `json:"name"`
+	Username    string     `json:"username"`
+	Status      string     `json:"status"`
+	Attempts    int        `json:"attempts"`
+	Error       string     `json:"error,omitempty"`
+	Created     time.Time  `json:"created"`
+	NextAttempt time.Time  `json:"next_attempt"`
+	Finished    *time.Time `json:"finished,omitempty"`
+	Stuck       bool       `json:"stuck"`
+}
+
+// Enqueue records teardown jobs for the IAM user of an instance and those of its bindings, and
+// removes the bindings. Nothing is deleted in IAM until the jobs are attempted.
+func Enqueue(db *sql.DB, name string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("INSERT INTO teardowns(name, username, status) SELECT name, username, $1 FROM bindings WHERE name=$2", Pending, name)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("DELETE FROM bindings WHERE name=$1", name)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("INSERT INTO teardowns(name, username, status) VALUES ($1, $1, $2)", name, Pending)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Finish attempts the due teardown jobs of an instance
+func Finish(db *sql.DB, name string) {
+	ids, err := dueJobs(db, "SELECT id FROM teardowns WHERE name=$1 AND status=$2 AND nextattempt <= now() ORDER BY id", name, Pending)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	for _, id := range ids {
+		attempt(db, id)
+	}
+}
+
+// IAM removes the IAM policy, access keys and user of an instance, and those of its bindings.
+// Whatever can't be removed right away is retried by RunJobs.
+func IAM(db *sql.DB, name string) {
+	err := Enqueue(db, name)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	Finish(db, name)
+}
+
+// Binding removes a binding and deletes its IAM user, access key and policy. It returns false
+// if IAM couldn't be cleaned up right away, in which case RunJobs retries it.
+func Binding(db *sql.DB, id string, username string) (bool, error) {
+	fmt.Println("Revoking binding " + id + "...")
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var job int
+	err = tx.QueryRow("INSERT INTO teardowns(name, username, status) SELECT name, username, $1 FROM bindings WHERE id=$2 RETURNING id", Pending, id).Scan(&job)
+	if err != nil {
+		return false, err
+	}
+	_, err = tx.Exec("DELETE FROM bindings WHERE id=$1", id)
+	if err != nil {
+		return false, err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return false, err
+	}
+
+	return attempt(db, job), nil
+}
+
+// RunJobs attempts every teardown job that is due
+func RunJobs(db *sql.DB) {
+	ids, err := dueJobs(db, "SELECT id FROM teardowns WHERE status=$1 AND nextattempt <= now() ORDER BY id", Pending)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	for _, id := range ids {
+		attempt(db, id)
+	}
+}
+
+// Retry makes a pending job due right away and attempts it, returning whether it finished
+func Retry(db *sql.DB, id int) (bool, error) {
+	result, err := db.Exec("UPDATE teardowns SET nextattempt=now() WHERE id=$1 AND status=$2", id, Pending)
+	if err != nil {
+		return false, err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return false, sql.ErrNoRows
+	}
+	return attempt(db, id), nil
+}
+
+// Jobs returns the pending teardown jobs, or only those that are stuck
+func Jobs(db *sql.DB, stuck bool) ([]Job, error) {
+	minimum := 0
+	if stuck {
+		minimum = StuckAttempts
+	}
+	rows, err := db.Query("SELECT id, name, username, status, attempts, coalesce(error, ''), created, nextattempt, finished FROM teardowns WHERE status=$1 AND attempts >= $2 ORDER BY id", Pending, minimum)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	jobs := []Job{}
+	for rows.Next() {
+		var j Job
+		err = rows.Scan(&j.ID, &j.Name, &j.Username, &j.Status, &j.Attempts, &j.Error, &j.Created, &j.NextAttempt, &j.Finished)
+		if err != nil {
+			return nil, err
+		}
+		j.Stuck = j.Attempts >= StuckAttempts
+		jobs = append(jobs, j)
+	}
+	return jobs, rows.Err()
+}
+
+// Attempt a job once. Removing an IAM user that is already gone counts as success. Failures
+// are recorded on the job, which is tried again after a backoff that doubles with every attempt.
+func attempt(db *sql.DB, id int) bool {
+	var username string
+	var attempts int
+	err := db.QueryRow("UPDATE teardowns SET nextattempt=now() + $1 * interval '1 second' WHERE id=$2 AND status=$3 AND nextattempt <= now() RETURNING username, attempts", int64(lease.Seconds()), id, Pending).Scan(&username, &attempts)
+	if err == sql.ErrNoRows {
+		// Finished or leased by someone else in the meantime
+		return false
+	} else if err != nil {
+		fmt.Println(err)
+		return false
+	}
+
+	fmt.Println("Removing IAM user " + username + "...")
+	rerr := credentials.Remove(username)
+	if rerr != nil {
+		fmt.Println("Unable to remove IAM user " + username + ": " + rerr.Error())
+		_, err = db.Exec("UPDATE teardowns SET attempts=attempts + 1, error=$1, nextattempt=now() + $2 * interval '1 second' WHERE id=$3", rerr.Error(), int64(backoff(attempts+1).Seconds()), id)
+		if err != nil {
+			fmt.Println(err)
+		}
+		return false
+	}
+
+	_, err = db.Exec("UPDATE teardowns SET status=$1, attempts=attempts + 1, error=NULL, finished=now() WHERE id=$2", Done, id)
+	if err != nil {
+		fmt.Println(err)
+		return false
+	}
+	return true
+}
+
+// Returns how long to wait after a number of failed attempts, from a minute up to maxBackoff
+func backoff(attempts int) time.Duration {
+	wait := time.Minute
+	for i := 1; i < attempts && wait < maxBackoff; i++ {
+		wait *= 2
+	}
+	if wait > maxBackoff {
+		return maxBackoff
+	}
+	return wait
+}
+
+func dueJobs(db *sql.DB, query string, args ...interface{}) ([]int, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []int
+	for rows.Next() {
+		var id int
+		err = rows.Scan(&id)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
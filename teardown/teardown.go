@@ -0,0 +1,174 @@
+package teardown
+
+import (
+	"database/sql"
+	"fmt"
+
+	cloud "neptune-aws-api/cloud"
+	credentials "neptune-aws-api/credentials"
+	lifecycle "neptune-aws-api/lifecycle"
+	replicas "neptune-aws-api/replicas"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/iam"
+	"github.com/aws/aws-sdk-go/service/neptune"
+)
+
+// Instance moves an instance to deleting and asks AWS to delete its instance and cluster. Unless
+// snapshot is empty, a final snapshot with that identifier is taken of the cluster. If AWS
+// refuses, the instance is marked failed.
+func Instance(db *sql.DB, name string, from string, snapshot string) error {
+	err := lifecycle.Transition(db, name, from, lifecycle.Deleting)
+	if err != nil {
+		fmt.Println(err.Error())
+		return err
+	}
+
+	svc := cloud.Neptune()
+
+	instanceParamsDelete := &neptune.DeleteDBInstanceInput{
+		DBInstanceIdentifier: aws.String(name),
+		SkipFinalSnapshot:    aws.Bool(true),
+	}
+
+	clusterParamsDelete := &neptune.DeleteDBClusterInput{
+		DBClusterIdentifier: aws.String(name),
+		SkipFinalSnapshot:   aws.Bool(true),
+	}
+	if snapshot != "" {
+		clusterParamsDelete.SkipFinalSnapshot = aws.Bool(false)
+		clusterParamsDelete.FinalDBSnapshotIdentifier = aws.String(snapshot)
+	}
+
+	// The cluster can only be deleted once all of its instances are being deleted
+	err = deleteReplicas(db, name)
+	if err != nil {
+		fmt.Println(err.Error())
+		markFailed(db, name)
+		return err
+	}
+
+	_, instanceErr := svc.DeleteDBInstance(instanceParamsDelete)
+	if instanceErr != nil && !IsNotFound(instanceErr) {
+		fmt.Println(instanceErr.Error())
+		markFailed(db, name)
+		return instanceErr
+	}
+	fmt.Println("Deletion in progress for instance " + name)
+
+	_, clusterErr := svc.DeleteDBCluster(clusterParamsDelete)
+	if IsNotFound(clusterErr) {
+		return nil
+	} else if clusterErr != nil {
+		fmt.Println(clusterErr.Error())
+		markFailed(db, name)
+		return clusterErr
+	}
+	fmt.Println("Deletion in progress for cluster " + name)
+
+	if snapshot != "" {
+		recordFinalSnapshot(db, name, snapshot)
+	}
+	return nil
+}
+
+// Delete the read replicas of an instance
+func deleteReplicas(db *sql.DB, name string) error {
+	rows, err := db.Query("SELECT id FROM replicas WHERE name=$1 AND status NOT IN ('deleting', 'deleted')", name)
+	if err != nil {
+		return err
+	}
+	var ids []string
+	for rows.Next() {
+		var id string
+		err = rows.Scan(&id)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+
+	for _, id := range ids {
+		_, err = replicas.Delete(db, id)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Record the final snapshot of an instance. It only appears in AWS once the cluster is being
+// deleted, so it is pending until the preprovisioner finds it.
+func recordFinalSnapshot(db *sql.DB, name string, snapshot string) {
+	_, err := db.Exec("UPDATE provision SET finalsnapshot=$1 WHERE name=$2", snapshot, name)
+	if err != nil {
+		fmt.Println(err.Error())
+	}
+	_, err = db.Exec("INSERT INTO snapshots(id, name, billingcode, status) SELECT $1, name, billingcode, 'pending' FROM provision WHERE name=$2", snapshot, name)
+	if err != nil {
+		fmt.Println(err.Error())
+	}
+}
+
+// Move an instance being deleted to the failed state, logging rather than returning any error
+func markFailed(db *sql.DB, name string) {
+	err := lifecycle.Transition(db, name, lifecycle.Deleting, lifecycle.Failed)
+	if err != nil {
+		fmt.Println(err.Error())
+	}
+}
+
+// SetKeysActive activates or deactivates the access keys of an instance and of its bindings,
+// without deleting anything
+func SetKeysActive(db *sql.DB, name string, active bool) error {
+	bindings, err := bindingUsers(db, name)
+	if err != nil {
+		return err
+	}
+
+	err = credentials.SetKeysActive(name, active)
+	if err != nil {
+		return err
+	}
+	for _, username := range bindings {
+		err = credentials.SetKeysActive(username, active)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns the IAM usernames of the bindings of an instance by binding id
+func bindingUsers(db *sql.DB, name string) (map[string]string, error) {
+	rows, err := db.Query("SELECT id, username FROM bindings WHERE name=$1", name)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	bindings := make(map[string]string)
+	for rows.Next() {
+		var id, username string
+		err = rows.Scan(&id, &username)
+		if err != nil {
+			return nil, err
+		}
+		bindings[id] = username
+	}
+	return bindings, rows.Err()
+}
+
+// IsNotFound returns whether an AWS error means the resource does not exist
+func IsNotFound(err error) bool {
+	if aerr, ok := err.(awserr.Error); ok {
+		switch aerr.Code() {
+		case neptune.ErrCodeDBInstanceNotFoundFault, neptune.ErrCodeDBClusterNotFoundFault, iam.ErrCodeNoSuchEntityException:
+			return true
+		}
+	}
+	return false
+}